@@ -26,11 +26,37 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 )
 
+var peerCredWarning sync.Once
+
+// checkPeer - Only allow clients running as the same user as the agent,
+// unless allowOtherUsers is set. Where peer credentials aren't available
+// only the socket permissions keep other users out, elsewhere clients that
+// can't be identified are rejected.
+func checkPeer(conn *ConnInfo, allowOtherUsers bool) error {
+	if allowOtherUsers {
+		return nil
+	}
+	if conn.Peer == nil && conn.PeerErr == errPeerCredUnsupported {
+		peerCredWarning.Do(func() {
+			fmt.Fprintln(os.Stderr, "Peer credentials are not supported on this platform, relying on the socket permissions to keep out other users")
+		})
+		return nil
+	}
+	if conn.Peer == nil {
+		return fmt.Errorf("Rejected client whose credentials could not be read: %s", conn.PeerErr)
+	}
+	if conn.Peer.UID != os.Getuid() {
+		return fmt.Errorf("Rejected client with uid %d, agent is running as uid %d", conn.Peer.UID, os.Getuid())
+	}
+	return nil
+}
+
 // AgentMain - run agent main loop
-func AgentMain(quiet bool, outputShell string, configPath string, sockPath string, backendAgent string, systemd bool) {
+func AgentMain(quiet bool, outputShell string, configPath string, profile string, sockPath string, backendAgent string, systemd bool, allowOtherUsers bool, watch bool) {
 	stderr := log.New(os.Stderr, "", 0)
 
 	if !quiet && !systemd {
@@ -47,9 +73,12 @@ func AgentMain(quiet bool, outputShell string, configPath string, sockPath strin
 		}
 	}
 
-	identities, err := ReadConfig(configPath)
+	// Remembers the passphrase for encrypted secrets across reloads
+	secrets := NewSecrets()
+
+	config, err := ReadAgentConfig(configPath, profile, secrets)
 	if err != nil {
-		stderr.Println(fmt.Sprintf("Missing configuration in '%s'", configPath))
+		stderr.Println(err)
 		os.Exit(1)
 	}
 
@@ -70,6 +99,11 @@ func AgentMain(quiet bool, outputShell string, configPath string, sockPath strin
 		if err != nil {
 			panic(fmt.Sprintf("Listen error: %s", err))
 		}
+		// Other users are rejected by checkPeer, except where that
+		// isn't supported
+		if err := os.Chmod(sockPath, 0600); err != nil {
+			stderr.Println(fmt.Sprintf("Could not restrict socket permissions: %s", err))
+		}
 		listeners = append(listeners, listener)
 
 		cleanup := func() {
@@ -82,7 +116,6 @@ func AgentMain(quiet bool, outputShell string, configPath string, sockPath strin
 		// Do cleanup regardless of how we exited
 		c := make(chan os.Signal, 1)
 		signal.Notify(c, os.Interrupt)
-		signal.Notify(c, syscall.SIGHUP)
 		signal.Notify(c, syscall.SIGTERM)
 		go func() {
 			for range c {
@@ -106,11 +139,42 @@ func AgentMain(quiet bool, outputShell string, configPath string, sockPath strin
 		panic(err)
 	}
 
-	keyring, err := NewProxyAgent(identities, agentBackend)
+	keyring, err := NewProxyAgent(config, agentBackend)
 	if err != nil {
 		panic(err)
 	}
 
+	reload := func(reason string) {
+		config, err := ReadAgentConfig(configPath, profile, secrets)
+		if err != nil {
+			stderr.Println(fmt.Sprintf("Not reloading configuration (%s): %s", reason, err))
+			return
+		}
+		err = keyring.Reload(config)
+		if err != nil {
+			stderr.Println(fmt.Sprintf("Not reloading configuration (%s): %s", reason, err))
+			return
+		}
+		stderr.Println(fmt.Sprintf("Reloaded configuration (%s)", reason))
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reload("SIGHUP")
+		}
+	}()
+
+	if watch {
+		err := WatchConfig(configPath, func() {
+			reload("file changed")
+		})
+		if err != nil {
+			stderr.Println(fmt.Sprintf("Could not watch configuration: %s", err))
+		}
+	}
+
 	agentConns := make(chan net.Conn)
 	for _, listener := range listeners {
 		go func(l net.Listener) {
@@ -131,8 +195,17 @@ func AgentMain(quiet bool, outputShell string, configPath string, sockPath strin
 		select {
 		case c := <-agentConns:
 			if c != nil {
+				conn := NewConnInfo(c)
+				if err := checkPeer(conn, allowOtherUsers); err != nil {
+					Audit(conn, "%s", err)
+					c.Close()
+					continue
+				}
+				Audit(conn, "accepted")
+
 				go func() {
-					err := agent.ServeAgent(keyring, c)
+					defer c.Close()
+					err := agent.ServeAgent(NewConnAgent(keyring, conn), conn.Watch())
 					if err != nil && err != io.EOF {
 						stderr.Print(err)
 					}
@@ -0,0 +1,46 @@
+/*
+Copyright 2017, Trusted Key
+This file is part of Trusted Key SSH-Agent.
+
+Trusted Key SSH-Agent is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Trusted Key SSH-Agent is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Trusted Key SSH-Agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestCheckPeer(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		conn    *ConnInfo
+		allowed bool
+	}{
+		{"same user", &ConnInfo{Peer: &PeerCred{UID: os.Getuid()}}, true},
+		{"other user", &ConnInfo{Peer: &PeerCred{UID: os.Getuid() + 1}}, false},
+		{"unreadable credentials", &ConnInfo{PeerErr: errors.New("getsockopt failed")}, false},
+		// The socket permissions keep other users out
+		{"unsupported platform", &ConnInfo{PeerErr: errPeerCredUnsupported}, true},
+	} {
+		if err := checkPeer(test.conn, false); (err == nil) != test.allowed {
+			t.Errorf("%s: expected allowed %v, got %v", test.name, test.allowed, err)
+		}
+		if err := checkPeer(test.conn, true); err != nil {
+			t.Errorf("%s: expected allowOtherUsers to accept it, got %v", test.name, err)
+		}
+	}
+}
@@ -19,11 +19,29 @@ along with Trusted Key SSH-Agent.  If not, see <http://www.gnu.org/licenses/>.
 package main
 
 import (
+	"bytes"
 	"encoding/json"
-	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 )
 
+// Version of the configuration file layout written by this agent.
+//
+// 0 - Identities keyed by public key at the top level next to "config"
+// 1 - Identities moved under "identities", added "version"
+// 2 - Client secrets may be encrypted or kept in the Secret Service
+// 3 - Named profiles under "profiles"
+// 4 - Identities record when they were enrolled
+// 5 - Identities record the files written by enroll
+const configVersion = 5
+
 // TKIdentity is the intermediate representation of configuration data
 // used for initializing internal data structures
 type TKIdentity struct {
@@ -34,85 +52,431 @@ type TKIdentity struct {
 	addr         string // Subject address
 }
 
-func fieldError(field string) error {
-	return errors.New(field + "does not exist in identity")
+// ConfigFile - On-disk layout of tk-ssh.json
+type ConfigFile struct {
+	Version    int                        `json:"version"`
+	Identities map[string]*IdentityConfig `json:"identities"` // Keyed by public key in hex
+	Profiles   map[string]*Profile        `json:"profiles,omitempty"`
+	Config     Settings                   `json:"config"`
+}
+
+// IdentityConfig - Credentials for an enrolled identity, the client secret
+// is stored in exactly one of ClientSecret, EncryptedSecret or SecretService
+type IdentityConfig struct {
+	RpURL           string        `json:"rpURL"`
+	ClientID        string        `json:"clientId"`
+	ClientSecret    string        `json:"clientSecret,omitempty"`
+	EncryptedSecret *SealedSecret `json:"encryptedSecret,omitempty"`
+	SecretService   bool          `json:"secretService,omitempty"`
+	Enrolled        *time.Time    `json:"enrolled,omitempty"` // Unknown for older identities
+
+	// Public key files written by enroll, removed again by unenroll
+	PubKeyFile  string   `json:"pubkeyFile,omitempty"`
+	ExportFiles []string `json:"exportFiles,omitempty"`
+	SSHConfig   string   `json:"sshConfig,omitempty"` // Has a managed block listing PubKeyFile
+}
+
+// Settings - The "config" section, zero values mean defaults
+type Settings struct {
+	Proxy          string                 `json:"proxy,omitempty"`
+	Policy         map[string]*PolicyRule `json:"policy,omitempty"`
+	SignTimeout    Seconds                `json:"signTimeout,omitempty"`
+	RequestTimeout Seconds                `json:"requestTimeout,omitempty"`
+	ApprovalWindow Seconds                `json:"approvalWindow,omitempty"`
+
+	// Prints the passphrase for encrypted secrets when there is no terminal
+	PassphraseCommand string `json:"passphraseCommand,omitempty"`
+
+	// Notification backends in order of preference, with their settings
+	Notify        []string `json:"notify,omitempty"`
+	NotifyCommand string   `json:"notifyCommand,omitempty"`
+	NotifyWebhook string   `json:"notifyWebhook,omitempty"`
+}
+
+// Seconds - A duration stored as (fractional) seconds
+type Seconds float64
+
+// Duration - Convert to time.Duration, falling back to def when unset
+func (s Seconds) Duration(def time.Duration) time.Duration {
+	if s == 0 {
+		return def
+	}
+	return time.Duration(float64(s) * float64(time.Second))
+}
+
+// ConfigError - A problem with the configuration file, with the position
+// in the file if known
+type ConfigError struct {
+	Path   string
+	Line   int // 1-based, zero if unknown
+	Column int
+	Field  string // e.g. "config.signTimeout", may be empty
+	Err    error
+}
+
+func (e *ConfigError) Error() string {
+	location := e.Path
+	if e.Line > 0 {
+		location = fmt.Sprintf("%s:%d:%d", location, e.Line, e.Column)
+	}
+	if e.Field != "" {
+		return fmt.Sprintf("%s: %s: %s", location, e.Field, e.Err)
+	}
+	return fmt.Sprintf("%s: %s", location, e.Err)
+}
+
+// ConfigErrors - All problems found in a configuration file
+type ConfigErrors []error
+
+func (e ConfigErrors) Error() string {
+	var lines []string
+	for _, err := range e {
+		lines = append(lines, err.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// position - Line and column of offset in contents
+func position(contents []byte, offset int64) (int, int) {
+	if offset > int64(len(contents)) {
+		offset = int64(len(contents))
+	}
+	before := contents[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := len(before) - bytes.LastIndex(before, []byte("\n"))
+	return line, column
+}
+
+// decodeStrict - Decode data (a slice of contents) into v, rejecting unknown
+// fields and reporting errors with their position in contents
+func decodeStrict(configPath string, contents []byte, data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == nil {
+		return nil
+	}
+
+	var offset int64
+	configErr := &ConfigError{Path: configPath, Err: err}
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		offset = e.Offset
+	case *json.UnmarshalTypeError:
+		offset = e.Offset
+		configErr.Field = e.Field
+		configErr.Err = fmt.Errorf("expected %s, got %s", e.Type, e.Value)
+	}
+
+	if err == io.ErrUnexpectedEOF {
+		offset = int64(len(data))
+	}
+
+	// The decoder doesn't say where unknown fields are, find the key
+	const unknownField = "json: unknown field "
+	if strings.HasPrefix(err.Error(), unknownField) {
+		name := strings.TrimPrefix(err.Error(), unknownField)
+		configErr.Err = fmt.Errorf("unknown field %s", name)
+		if index := bytes.Index(data, []byte(name)); index >= 0 {
+			offset = int64(index)
+		}
+	}
+
+	base := bytes.Index(contents, data)
+	if base < 0 {
+		base = 0
+	}
+	configErr.Line, configErr.Column = position(contents, int64(base)+offset)
+	return configErr
 }
 
-func hasKey(configData map[string]interface{}, key string) bool {
-	val, ok := configData[key]
-	return ok && val != nil
+// fieldError - A semantic error in a field, positioned at key if it's found
+func fieldError(configPath string, contents []byte, key string, field string, err error) error {
+	configErr := &ConfigError{Path: configPath, Field: field, Err: err}
+	if offset := bytes.Index(contents, []byte(`"`+key+`"`)); offset >= 0 && key != "" {
+		configErr.Line, configErr.Column = position(contents, int64(offset))
+	}
+	return configErr
 }
 
-// ReadConfigRaw ...
-func ReadConfigRaw(configPath string) map[string]interface{} {
-	data := make(map[string]interface{})
+// NewConfigFile - An empty configuration in the current layout
+func NewConfigFile() *ConfigFile {
+	return &ConfigFile{
+		Version:    configVersion,
+		Identities: make(map[string]*IdentityConfig),
+	}
+}
 
+// parseConfigFile - Decode any known layout, returning the layout version found
+func parseConfigFile(configPath string, contents []byte) (*ConfigFile, int, error) {
+	var raw map[string]json.RawMessage
+	if err := decodeStrict(configPath, contents, contents, &raw); err != nil {
+		return nil, 0, err
+	}
+
+	config := NewConfigFile()
+	if _, ok := raw["version"]; ok {
+		if err := decodeStrict(configPath, contents, contents, config); err != nil {
+			return nil, 0, err
+		}
+		if config.Version > configVersion {
+			return nil, 0, &ConfigError{Path: configPath, Field: "version",
+				Err: fmt.Errorf("unsupported version %d, this agent supports up to %d", config.Version, configVersion)}
+		}
+		if config.Identities == nil {
+			config.Identities = make(map[string]*IdentityConfig)
+		}
+		return config, config.Version, nil
+	}
+
+	// Version 0
+	for key, value := range raw {
+		if key == "config" {
+			if err := decodeStrict(configPath, contents, value, &config.Config); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+
+		identity := &IdentityConfig{}
+		if err := decodeStrict(configPath, contents, value, identity); err != nil {
+			return nil, 0, err
+		}
+		config.Identities[key] = identity
+	}
+	return config, 0, nil
+}
+
+// ReadConfigFile - Read and decode the configuration, a missing file is an
+// empty configuration. Files in an older layout are left alone until the
+// configuration is written again (see WriteConfigFile).
+func ReadConfigFile(configPath string) (*ConfigFile, error) {
 	contents, err := ioutil.ReadFile(configPath)
+	if os.IsNotExist(err) {
+		return NewConfigFile(), nil
+	}
 	if err != nil {
-		return data
+		return nil, err
 	}
 
-	if err := json.Unmarshal(contents, &data); err != nil {
-		panic(err)
+	config, _, err := parseConfigFile(configPath, contents)
+	if err != nil {
+		return nil, err
 	}
+	return config, nil
+}
 
-	return data
+// backupConfigFile - Keep a copy of a file in an older layout next to it,
+// with a ".v<version>" suffix, before it is overwritten in the current one
+func backupConfigFile(configPath string) error {
+	contents, err := ioutil.ReadFile(configPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Version 0 has no version field
+	var header struct {
+		Version int `json:"version"`
+	}
+	if json.Unmarshal(contents, &header) != nil || header.Version >= configVersion {
+		return nil
+	}
+
+	// Don't replace the backup of an earlier migration
+	backupPath := fmt.Sprintf("%s.v%d", configPath, header.Version)
+	if _, err := os.Stat(backupPath); err == nil {
+		return nil
+	}
+	if err := ioutil.WriteFile(backupPath, contents, 0600); err != nil {
+		return fmt.Errorf("Could not back up %s before migrating it: %s", configPath, err)
+	}
+	return nil
 }
 
-// ReadConfigExtra ...
-func ReadConfigExtra(configPath string) map[string]interface{} {
-	jsonData := ReadConfigRaw(configPath)
-	var configData map[string]interface{}
-	if hasKey(jsonData, "config") {
-		configData = jsonData["config"].(map[string]interface{})
-	} else {
-		configData = make(map[string]interface{})
+// MigrateConfigFile - Rewrite configPath in the current layout, returning
+// the layout version it was in
+func MigrateConfigFile(configPath string) (int, error) {
+	contents, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return 0, err
+	}
+
+	config, version, err := parseConfigFile(configPath, contents)
+	if err != nil {
+		return 0, err
 	}
-	return configData
+	if version == configVersion {
+		return version, nil
+	}
+	return version, WriteConfigFile(configPath, config)
 }
 
-// WriteConfigRaw ...
-func WriteConfigRaw(configPath string, config map[string]interface{}) error {
+// WriteConfigFile - Atomically replace the configuration file, a file in an
+// older layout is backed up first
+func WriteConfigFile(configPath string, config *ConfigFile) error {
+	if err := backupConfigFile(configPath); err != nil {
+		return err
+	}
+	config.Version = configVersion
+
 	outputJSON, err := json.MarshalIndent(config, "", "  ")
 	if err != nil {
 		return err
 	}
 
-	err = ioutil.WriteFile(configPath, outputJSON, 0600)
+	tmpFile, err := ioutil.TempFile(filepath.Dir(configPath), filepath.Base(configPath)+".tmp")
 	if err != nil {
 		return err
 	}
+	defer os.Remove(tmpFile.Name())
 
-	return nil
+	_, err = tmpFile.Write(append(outputJSON, '\n'))
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	// TempFile already creates the file with 0600
+	return os.Rename(tmpFile.Name(), configPath)
 }
 
-// ReadConfig ...
-func ReadConfig(path string) ([]TKIdentity, error) {
-	data := ReadConfigRaw(path)
+// Validate - Check values beyond their JSON types, contents is the file the
+// config was read from (for error positions) and may be nil
+func (c *ConfigFile) Validate(configPath string, contents []byte) ConfigErrors {
+	var errs ConfigErrors
 
-	var tkIdentities []TKIdentity
-	for key, values := range data {
+	var keys []string
+	for key := range c.Identities {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
 
-		if key == "config" {
+	for _, key := range keys {
+		identity := c.Identities[key]
+		field := "identities." + key
+		if identity == nil {
+			errs = append(errs, fieldError(configPath, contents, key, field, fmt.Errorf("missing identity")))
 			continue
 		}
+		if _, err := UserPubKeyHexToSSHPubKey([]byte(key)); err != nil {
+			errs = append(errs, fieldError(configPath, contents, key, field, fmt.Errorf("invalid public key")))
+		}
+		if u, err := url.ParseRequestURI(identity.RpURL); err != nil || u.Host == "" {
+			errs = append(errs, fieldError(configPath, contents, key, field+".rpURL", fmt.Errorf("invalid URL %q", identity.RpURL)))
+		}
+		if identity.ClientID == "" {
+			errs = append(errs, fieldError(configPath, contents, key, field+".clientId", fmt.Errorf("missing")))
+		}
+		stores := 0
+		if identity.ClientSecret != "" {
+			stores++
+		}
+		if identity.EncryptedSecret != nil {
+			stores++
+		}
+		if identity.SecretService {
+			stores++
+		}
+		if stores != 1 {
+			errs = append(errs, fieldError(configPath, contents, key, field,
+				fmt.Errorf("expected exactly one of clientSecret, encryptedSecret or secretService")))
+		}
+	}
+
+	errs = append(errs, c.validateSettings(configPath, contents, "config", &c.Config)...)
 
-		v := values.(map[string]interface{})
-		rpURL := v["rpURL"]
-		if rpURL == nil {
-			return nil, fieldError("rpURL")
+	for _, name := range c.profileNames() {
+		profile := c.Profiles[name]
+		field := "profiles." + name
+		if !profileNamePattern.MatchString(name) {
+			errs = append(errs, fieldError(configPath, contents, name, field, fmt.Errorf("invalid name, use only letters, digits, '-' and '_'")))
+		}
+		if profile == nil {
+			errs = append(errs, fieldError(configPath, contents, name, field, fmt.Errorf("missing profile")))
+			continue
 		}
+		if profile.RpURL != "" {
+			if u, err := url.ParseRequestURI(profile.RpURL); err != nil || u.Host == "" {
+				errs = append(errs, fieldError(configPath, contents, name, field+".rpURL", fmt.Errorf("invalid URL %q", profile.RpURL)))
+			}
+		}
+		for _, entry := range profile.Identities {
+			found := false
+			for key := range c.Identities {
+				if matchIdentity(entry, key) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				errs = append(errs, fieldError(configPath, contents, entry, field+".identities",
+					fmt.Errorf("%q is not an enrolled public key or subject address", entry)))
+			}
+		}
+		errs = append(errs, c.validateSettings(configPath, contents, field+".config", &profile.Config)...)
+	}
+
+	return errs
+}
 
-		clientID := v["clientId"]
-		if clientID == nil {
-			return nil, fieldError("clientId")
+// validateSettings - Check a "config" section, field is its path in the file
+func (c *ConfigFile) validateSettings(configPath string, contents []byte, field string, settings *Settings) ConfigErrors {
+	var errs ConfigErrors
+
+	seconds := map[string]Seconds{
+		"signTimeout":    settings.SignTimeout,
+		"requestTimeout": settings.RequestTimeout,
+		"approvalWindow": settings.ApprovalWindow,
+	}
+	for _, key := range []string{"signTimeout", "requestTimeout", "approvalWindow"} {
+		if seconds[key] < 0 {
+			errs = append(errs, fieldError(configPath, contents, key, field+"."+key, fmt.Errorf("must not be negative")))
 		}
+	}
 
-		clientSecret := v["clientSecret"]
-		if clientSecret == nil {
-			return nil, fieldError("clientSecret")
+	for key := range settings.Policy {
+		if key == "*" || strings.HasPrefix(key, "0x") || c.Identities[key] != nil {
+			continue
 		}
+		errs = append(errs, fieldError(configPath, contents, key, field+".policy."+key,
+			fmt.Errorf("expected \"*\", a subject address or an enrolled public key")))
+	}
+
+	if err := validateNotify(settings); err != nil {
+		errs = append(errs, fieldError(configPath, contents, "notify", field+".notify", err))
+	}
+
+	return errs
+}
+
+// ValidateConfigFile - Read configPath and report every problem found
+func ValidateConfigFile(configPath string) error {
+	contents, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
 
+	config, _, err := parseConfigFile(configPath, contents)
+	if err != nil {
+		return err
+	}
+
+	if errs := config.Validate(configPath, contents); len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// TKIdentities - Identities in the form used by the agent, with client
+// secrets resolved through secrets
+func (c *ConfigFile) TKIdentities(secrets *Secrets) ([]TKIdentity, error) {
+	var tkIdentities []TKIdentity
+	for key, v := range c.Identities {
 		pub := []byte(key)
 
 		addr, err := UserPubKeyHexToAddress(pub)
@@ -120,16 +484,89 @@ func ReadConfig(path string) ([]TKIdentity, error) {
 			return nil, err
 		}
 
-		identity := TKIdentity{
-			pubkey:       []byte(key),
-			rpURL:        rpURL.(string),
-			clientID:     clientID.(string),
-			clientSecret: clientSecret.(string),
-			addr:         addr,
+		clientSecret, err := secrets.Resolve(key, v)
+		if err != nil {
+			return nil, fmt.Errorf("Could not get client secret for %s: %s", addr, err)
 		}
 
-		tkIdentities = append(tkIdentities, identity)
+		tkIdentities = append(tkIdentities, TKIdentity{
+			pubkey:       pub,
+			rpURL:        v.RpURL,
+			clientID:     v.ClientID,
+			clientSecret: clientSecret,
+			addr:         addr,
+		})
 	}
 
 	return tkIdentities, nil
 }
+
+// SignOptions - Signing flow settings, falling back to DefaultSignOptions
+func (s *Settings) SignOptions() SignOptions {
+	return SignOptions{
+		SignTimeout:    s.SignTimeout.Duration(DefaultSignOptions.SignTimeout),
+		RequestTimeout: s.RequestTimeout.Duration(DefaultSignOptions.RequestTimeout),
+		ApprovalWindow: s.ApprovalWindow.Duration(DefaultSignOptions.ApprovalWindow),
+	}
+}
+
+// ReadConfig - Read the enrolled identities
+func ReadConfig(configPath string, secrets *Secrets) ([]TKIdentity, error) {
+	config, err := ReadConfigFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := config.EffectiveSettings()
+	if err != nil {
+		return nil, err
+	}
+	secrets.SetPassphraseCommand(settings.PassphraseCommand)
+
+	return config.TKIdentities(secrets)
+}
+
+// AgentConfig - Everything the agent reads from the configuration file
+type AgentConfig struct {
+	Identities []TKIdentity
+	Policy     *Policy
+	Options    SignOptions
+	Notifier   Notifier
+}
+
+// ReadAgentConfig - Read and validate identities and agent settings for a
+// profile (all identities if empty)
+func ReadAgentConfig(configPath string, profile string, secrets *Secrets) (*AgentConfig, error) {
+	config, err := ReadConfigFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	selected, err := config.Select(profile)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := selected.EffectiveSettings()
+	if err != nil {
+		return nil, err
+	}
+
+	// Environment overrides are validated like the file
+	effective := *config
+	effective.Config = *settings
+	if errs := effective.Validate(configPath, nil); len(errs) > 0 {
+		return nil, errs
+	}
+	secrets.SetPassphraseCommand(settings.PassphraseCommand)
+
+	identities, err := selected.TKIdentities(secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AgentConfig{
+		Identities: identities,
+		Policy:     NewPolicy(settings.Policy),
+		Options:    settings.SignOptions(),
+		Notifier:   settings.Notifier(),
+	}, nil
+}
@@ -0,0 +1,249 @@
+/*
+Copyright 2017, Trusted Key
+This file is part of Trusted Key SSH-Agent.
+
+Trusted Key SSH-Agent is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Trusted Key SSH-Agent is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Trusted Key SSH-Agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testPubKey = "049231c1ba77dc29ec62188ae766c8455f7efb98b1ec7711d6f3333c2d8938970c301f79fab770c570014c3aaa2ec2b40fcfb03520fc503a6f6ed44f8da7e93770"
+
+// Layout written before "version" existed
+const testConfigV0 = `{
+  "` + testPubKey + `": {
+    "rpURL": "https://rp.example.com",
+    "clientId": "client",
+    "clientSecret": "secret"
+  },
+  "config": {
+    "signTimeout": 60
+  }
+}
+`
+
+func writeTestConfig(t *testing.T, contents string) (string, func()) {
+	dir, err := ioutil.TempDir("", "tk-ssh-conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configPath := filepath.Join(dir, "tk-ssh.json")
+	if err := ioutil.WriteFile(configPath, []byte(contents), 0600); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return configPath, func() { os.RemoveAll(dir) }
+}
+
+func checkTestIdentity(t *testing.T, config *ConfigFile) {
+	identity := config.Identities[testPubKey]
+	if identity == nil {
+		t.Fatalf("identity missing, got %v", config.Identities)
+	}
+	if identity.RpURL != "https://rp.example.com" || identity.ClientID != "client" || identity.ClientSecret != "secret" {
+		t.Errorf("identity not migrated: %+v", identity)
+	}
+	if config.Config.SignTimeout != 60 {
+		t.Errorf("expected signTimeout 60, got %v", config.Config.SignTimeout)
+	}
+}
+
+func TestReadConfigFileLeavesOldLayout(t *testing.T) {
+	configPath, cleanup := writeTestConfig(t, testConfigV0)
+	defer cleanup()
+
+	config, err := ReadConfigFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestIdentity(t, config)
+
+	contents, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != testConfigV0 {
+		t.Errorf("reading changed the file:\n%s", contents)
+	}
+	if _, err := os.Stat(configPath + ".v0"); !os.IsNotExist(err) {
+		t.Errorf("reading wrote a backup: %v", err)
+	}
+}
+
+func TestMigrateConfigFile(t *testing.T) {
+	configPath, cleanup := writeTestConfig(t, testConfigV0)
+	defer cleanup()
+
+	version, err := MigrateConfigFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 0 {
+		t.Errorf("expected version 0, got %d", version)
+	}
+
+	backup, err := ioutil.ReadFile(configPath + ".v0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(backup) != testConfigV0 {
+		t.Errorf("backup differs from the original:\n%s", backup)
+	}
+
+	contents, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, version, err := parseConfigFile(configPath, contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != configVersion {
+		t.Errorf("expected version %d after migrating, got %d", configVersion, version)
+	}
+	checkTestIdentity(t, config)
+
+	// Already current, nothing to do
+	version, err = MigrateConfigFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != configVersion {
+		t.Errorf("expected version %d, got %d", configVersion, version)
+	}
+	again, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(contents, again) {
+		t.Error("migrating a current file changed it")
+	}
+}
+
+func TestWriteConfigFileKeepsFirstBackup(t *testing.T) {
+	configPath, cleanup := writeTestConfig(t, testConfigV0)
+	defer cleanup()
+
+	if err := ioutil.WriteFile(configPath+".v0", []byte("earlier"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteConfigFile(configPath, NewConfigFile()); err != nil {
+		t.Fatal(err)
+	}
+	backup, err := ioutil.ReadFile(configPath + ".v0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(backup) != "earlier" {
+		t.Errorf("existing backup was replaced with:\n%s", backup)
+	}
+}
+
+func TestReadConfigFileUnknownField(t *testing.T) {
+	configPath, cleanup := writeTestConfig(t, `{
+  "version": 4,
+  "identities": {},
+  "config": {
+    "signTimeot": 60
+  }
+}
+`)
+	defer cleanup()
+
+	_, err := ReadConfigFile(configPath)
+	configErr, ok := err.(*ConfigError)
+	if !ok {
+		t.Fatalf("expected a ConfigError, got %v", err)
+	}
+	if configErr.Line != 5 {
+		t.Errorf("expected the error on line 5, got %d (%s)", configErr.Line, configErr)
+	}
+}
+
+// The sample must not trigger a migration and backup when copied
+func TestSampleConfigIsCurrent(t *testing.T) {
+	contents, err := ioutil.ReadFile("conf.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, version, err := parseConfigFile("conf.json", contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != configVersion {
+		t.Errorf("conf.json is version %d, expected %d", version, configVersion)
+	}
+	if errs := config.Validate("conf.json", contents); len(errs) > 0 {
+		t.Errorf("conf.json is invalid: %v", errs)
+	}
+}
+
+func TestSettingSources(t *testing.T) {
+	for _, key := range []string{"proxy", "signTimeout", "requestTimeout"} {
+		if value, ok := os.LookupEnv(EnvName(key)); ok {
+			defer os.Setenv(EnvName(key), value)
+		} else {
+			defer os.Unsetenv(EnvName(key))
+		}
+	}
+	os.Setenv(EnvName("proxy"), "/env.sock")
+	os.Setenv(EnvName("signTimeout"), "")
+	os.Unsetenv(EnvName("requestTimeout"))
+
+	file := &Settings{Proxy: "/file.sock", SignTimeout: 60, RequestTimeout: 30}
+	flags := map[string]string{}
+	sources := func() map[string]SettingValue {
+		settings := *file
+		if err := settings.ApplyEnv(); err != nil {
+			t.Fatal(err)
+		}
+		if err := settings.ApplyFlags(flags); err != nil {
+			t.Fatal(err)
+		}
+		values := make(map[string]SettingValue)
+		for _, option := range settingOptions {
+			values[option.Key] = option.effective(file, nil, flags, &settings)
+		}
+		return values
+	}
+
+	values := sources()
+	if v := values["proxy"]; v.Source != "env" || v.Value != "/env.sock" {
+		t.Errorf("proxy: expected /env.sock from env, got %+v", v)
+	}
+	// An empty variable clears the setting, the default applies
+	if v := values["signTimeout"]; v.Source != "default" || v.Value != DefaultSignOptions.SignTimeout.Seconds() {
+		t.Errorf("signTimeout: expected the default, got %+v", v)
+	}
+	if v := values["requestTimeout"]; v.Source != "config" || v.Value != float64(30) {
+		t.Errorf("requestTimeout: expected 30 from config, got %+v", v)
+	}
+
+	flags["proxy"] = "/flag.sock"
+	if v := sources()["proxy"]; v.Source != "flag" || v.Value != "/flag.sock" {
+		t.Errorf("proxy: expected /flag.sock from flag, got %+v", v)
+	}
+	flags["proxy"] = ""
+	if v := sources()["proxy"]; v.Source != "default" || v.Value != "" {
+		t.Errorf("proxy: expected an empty flag to clear it, got %+v", v)
+	}
+}
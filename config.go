@@ -18,26 +18,386 @@ along with Trusted Key SSH-Agent.  If not, see <http://www.gnu.org/licenses/>.
 
 package main
 
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// settingOption describes a key of the "config" section for the config command
+type settingOption struct {
+	Key         string
+	Description string
+	Default     interface{}
+
+	get   func(s *Settings) (interface{}, bool) // Value and whether it's set
+	set   func(s *Settings, value string) error
+	unset func(s *Settings)
+	copy  func(dst *Settings, src *Settings)
+}
+
+func stringOption(key string, description string, field func(s *Settings) *string) settingOption {
+	return settingOption{
+		Key:         key,
+		Description: description,
+		Default:     "",
+		get: func(s *Settings) (interface{}, bool) {
+			return *field(s), *field(s) != ""
+		},
+		set: func(s *Settings, value string) error {
+			*field(s) = value
+			return nil
+		},
+		unset: func(s *Settings) {
+			*field(s) = ""
+		},
+		copy: func(dst *Settings, src *Settings) {
+			*field(dst) = *field(src)
+		},
+	}
+}
+
+func secondsOption(key string, description string, def float64, field func(s *Settings) *Seconds) settingOption {
+	return settingOption{
+		Key:         key,
+		Description: description,
+		Default:     def,
+		get: func(s *Settings) (interface{}, bool) {
+			return float64(*field(s)), *field(s) != 0
+		},
+		set: func(s *Settings, value string) error {
+			seconds, err := strconv.ParseFloat(value, 64)
+			if err != nil || seconds <= 0 {
+				return fmt.Errorf("%s: expected a positive number of seconds", key)
+			}
+			*field(s) = Seconds(seconds)
+			return nil
+		},
+		unset: func(s *Settings) {
+			*field(s) = 0
+		},
+		copy: func(dst *Settings, src *Settings) {
+			*field(dst) = *field(src)
+		},
+	}
+}
+
+func listOption(key string, description string, def []string, field func(s *Settings) *[]string) settingOption {
+	return settingOption{
+		Key:         key,
+		Description: description,
+		Default:     def,
+		get: func(s *Settings) (interface{}, bool) {
+			return *field(s), len(*field(s)) > 0
+		},
+		set: func(s *Settings, value string) error {
+			*field(s) = splitList(value)
+			return nil
+		},
+		unset: func(s *Settings) {
+			*field(s) = nil
+		},
+		copy: func(dst *Settings, src *Settings) {
+			*field(dst) = *field(src)
+		},
+	}
+}
+
+// settingOptions - Everything that can be set in the "config" section
+var settingOptions = []settingOption{
+	stringOption("proxy", "Proxy unknown identities to agent unix domain socket",
+		func(s *Settings) *string { return &s.Proxy }),
+	secondsOption("signTimeout", "Seconds to wait for a login to be approved",
+		DefaultSignOptions.SignTimeout.Seconds(),
+		func(s *Settings) *Seconds { return &s.SignTimeout }),
+	secondsOption("requestTimeout", "Seconds each request to the relying party may take",
+		DefaultSignOptions.RequestTimeout.Seconds(),
+		func(s *Settings) *Seconds { return &s.RequestTimeout }),
+	secondsOption("approvalWindow", "Seconds the relying party may approve repeated logins to a host without asking again, if it supports that (0 disables)",
+		DefaultSignOptions.ApprovalWindow.Seconds(),
+		func(s *Settings) *Seconds { return &s.ApprovalWindow }),
+	stringOption("passphraseCommand", "Command printing the secrets passphrase when there is no terminal",
+		func(s *Settings) *string { return &s.PassphraseCommand }),
+	listOption("notify", "Notification backends to try in order (dbus, libnotify, osascript, msg, tty, client-tty, command, webhook, none)",
+		defaultNotifyBackends(),
+		func(s *Settings) *[]string { return &s.Notify }),
+	stringOption("notifyCommand", "Command for the \"command\" backend, gets TK_SSH_TITLE, TK_SSH_MESSAGE and TK_SSH_OTP",
+		func(s *Settings) *string { return &s.NotifyCommand }),
+	stringOption("notifyWebhook", "URL the \"webhook\" backend POSTs requests to as JSON",
+		func(s *Settings) *string { return &s.NotifyWebhook }),
+	{
+		Key:         "policy",
+		Description: "Allow-list of processes, hosts and users per identity (JSON)",
+		Default:     map[string]*PolicyRule{},
+		get: func(s *Settings) (interface{}, bool) {
+			return s.Policy, len(s.Policy) > 0
+		},
+		set: func(s *Settings, value string) error {
+			var policy map[string]*PolicyRule
+			if err := decodeStrict("policy", []byte(value), []byte(value), &policy); err != nil {
+				return err
+			}
+			s.Policy = policy
+			return nil
+		},
+		unset: func(s *Settings) {
+			s.Policy = nil
+		},
+		copy: func(dst *Settings, src *Settings) {
+			dst.Policy = src.Policy
+		},
+	},
+}
+
+// Merge - Settings with every option set in override replacing ours
+func (s Settings) Merge(override *Settings) Settings {
+	for _, option := range settingOptions {
+		if _, ok := option.get(override); ok {
+			option.copy(&s, override)
+		}
+	}
+	return s
+}
+
+func findSettingOption(key string) (*settingOption, error) {
+	for i := range settingOptions {
+		if settingOptions[i].Key == key {
+			return &settingOptions[i], nil
+		}
+	}
+
+	var keys []string
+	for _, option := range settingOptions {
+		keys = append(keys, option.Key)
+	}
+	sort.Strings(keys)
+	return nil, fmt.Errorf("Unknown option '%s', expected one of: %s", key, strings.Join(keys, ", "))
+}
+
+// SettingValue - Effective value of an option and where it came from
+type SettingValue struct {
+	Key         string      `json:"key"`
+	Value       interface{} `json:"value"`
+	Source      string      `json:"source"` // "flag", "env", "profile", "config" or "default"
+	Env         string      `json:"env"`
+	Description string      `json:"description"`
+}
+
+// effective - Value of the option from the config file settings, the
+// profile settings (may be nil), the command line flags and the effective
+// settings (see EffectiveSettings, with the flags applied)
+func (o *settingOption) effective(file *Settings, profile *Settings, flags map[string]string, settings *Settings) SettingValue {
+	value := SettingValue{
+		Key:         o.Key,
+		Value:       o.Default,
+		Source:      "default",
+		Env:         EnvName(o.Key),
+		Description: o.Description,
+	}
+	v, ok := o.get(settings)
+	if !ok {
+		// Never set, or cleared by an empty flag or variable
+		return value
+	}
+	value.Value = v
+
+	inProfile := false
+	if profile != nil {
+		_, inProfile = o.get(profile)
+	}
+	_, inFlags := flags[o.Key]
+	_, inEnv := os.LookupEnv(value.Env)
+	if inFlags {
+		value.Source = "flag"
+	} else if inEnv {
+		value.Source = "env"
+	} else if inProfile {
+		value.Source = "profile"
+	} else if _, ok := o.get(file); ok {
+		value.Source = "config"
+	}
+	return value
+}
+
+// formatSetting - Plain text form of a value, as accepted by "config set"
+func formatSetting(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []string:
+		return strings.Join(v, ",")
+	default:
+		out, _ := json.Marshal(v)
+		return string(out)
+	}
+}
+
 // ConfigMain ...
 func ConfigMain(configPath string, configProxy *string) error {
-	jsonData := ReadConfigRaw(configPath)
-
-	var configData map[string]interface{}
-	if hasKey(jsonData, "config") {
-		configData = jsonData["config"].(map[string]interface{})
-	} else {
-		configData = make(map[string]interface{})
+	config, err := ReadConfigFile(configPath)
+	if err != nil {
+		return err
 	}
 
 	if configProxy != nil {
-		if *configProxy == "" {
-			delete(configData, "proxy")
+		config.Config.Proxy = *configProxy
+	}
+
+	return WriteConfigFile(configPath, config)
+}
+
+// ConfigActionMain - Run "config get|set|unset|list|validate|migrate", on
+// the settings of profile if not empty. flags holds the settings passed on
+// the command line (e.g. --proxy), get and list show them like the agent
+// would use them.
+func ConfigActionMain(configPath string, profile string, action string, args []string, flags map[string]string, jsonOutput bool) error {
+	expectArgs := func(n int, usage string) error {
+		if len(args) != n {
+			return fmt.Errorf("Usage: config %s", usage)
+		}
+		return nil
+	}
+
+	if len(flags) > 0 && action != "get" && action != "list" {
+		return fmt.Errorf("Setting flags like --proxy only apply to config get and list, not %s", action)
+	}
+
+	if action == "validate" {
+		if err := expectArgs(0, "validate"); err != nil {
+			return err
+		}
+		if err := ValidateConfigFile(configPath); err != nil {
+			return err
+		}
+		fmt.Println("Configuration is valid")
+		return nil
+	}
+
+	if action == "migrate" {
+		if err := expectArgs(0, "migrate"); err != nil {
+			return err
+		}
+		version, err := MigrateConfigFile(configPath)
+		if err != nil {
+			return err
+		}
+		if version == configVersion {
+			fmt.Println("Configuration is up to date")
 		} else {
-			configData["proxy"] = *configProxy
+			fmt.Println(fmt.Sprintf("Migrated configuration from version %d to %d, the original is kept as %s.v%d", version, configVersion, configPath, version))
 		}
+		return nil
 	}
 
-	jsonData["config"] = configData
+	config, err := ReadConfigFile(configPath)
+	if err != nil {
+		return err
+	}
+
+	// The settings being changed, set creates missing profiles
+	target := &config.Config
+	var profileSettings *Settings
+	if profile != "" {
+		if config.Profiles[profile] == nil && action == "set" {
+			if err := ValidateProfileName(profile); err != nil {
+				return err
+			}
+			if config.Profiles == nil {
+				config.Profiles = make(map[string]*Profile)
+			}
+			config.Profiles[profile] = &Profile{}
+		}
+		p, err := config.GetProfile(profile)
+		if err != nil {
+			return err
+		}
+		target = &p.Config
+		profileSettings = &p.Config
+	}
 
-	return WriteConfigRaw(configPath, jsonData)
+	selected, err := config.Select(profile)
+	if err != nil {
+		return err
+	}
+	settings, err := selected.EffectiveSettings()
+	if err != nil {
+		return err
+	}
+	if err := settings.ApplyFlags(flags); err != nil {
+		return err
+	}
+
+	switch action {
+	case "list":
+		if err := expectArgs(0, "list"); err != nil {
+			return err
+		}
+		var values []SettingValue
+		for _, option := range settingOptions {
+			values = append(values, option.effective(&config.Config, profileSettings, flags, settings))
+		}
+		if jsonOutput {
+			return json.NewEncoder(os.Stdout).Encode(values)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, value := range values {
+			fmt.Fprintf(w, "%s\t%s\t(%s)\n", value.Key, formatSetting(value.Value), value.Source)
+		}
+		return w.Flush()
+
+	case "get":
+		if err := expectArgs(1, "get <key>"); err != nil {
+			return err
+		}
+		option, err := findSettingOption(args[0])
+		if err != nil {
+			return err
+		}
+		value := option.effective(&config.Config, profileSettings, flags, settings)
+		if jsonOutput {
+			return json.NewEncoder(os.Stdout).Encode(value)
+		}
+		fmt.Println(formatSetting(value.Value))
+		return nil
+
+	case "set", "unset":
+		if action == "set" {
+			err = expectArgs(2, "set <key> <value>")
+		} else {
+			err = expectArgs(1, "unset <key>")
+		}
+		if err != nil {
+			return err
+		}
+		option, err := findSettingOption(args[0])
+		if err != nil {
+			return err
+		}
+
+		if action == "set" {
+			if err := option.set(target, args[1]); err != nil {
+				return err
+			}
+		} else {
+			option.unset(target)
+		}
+
+		// Never write a file the agent would refuse to load
+		if errs := config.Validate(configPath, nil); len(errs) > 0 {
+			return errs
+		}
+		if _, ok := os.LookupEnv(EnvName(option.Key)); ok {
+			fmt.Fprintln(os.Stderr, fmt.Sprintf("Note: %s overrides this setting", EnvName(option.Key)))
+		}
+		return WriteConfigFile(configPath, config)
+
+	default:
+		return fmt.Errorf("Unknown config action '%s', expected get, set, unset, list, validate or migrate", action)
+	}
 }
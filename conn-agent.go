@@ -0,0 +1,292 @@
+/*
+Copyright 2017, Trusted Key
+This file is part of Trusted Key SSH-Agent.
+
+Trusted Key SSH-Agent is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Trusted Key SSH-Agent is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Trusted Key SSH-Agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var connCounter uint64
+
+// errPeerCredUnsupported - GetPeerCred isn't implemented for this platform
+var errPeerCredUnsupported = errors.New("Peer credentials not supported on this platform")
+
+// PeerCred - The process on the other end of an agent connection
+type PeerCred struct {
+	Pid     int
+	UID     int
+	GID     int
+	Exe     string // Path to the executable, empty if unknown
+	Cmdline string
+	Parents []string // Command lines of the parent processes, closest first
+}
+
+func commandName(cmdline string) string {
+	fields := strings.Fields(cmdline)
+	if len(fields) == 0 {
+		return "?"
+	}
+	return filepath.Base(fields[0])
+}
+
+// Chain - Names of the process and it's parents, e.g. "ssh <- bash <- tmux"
+func (p *PeerCred) Chain() string {
+	names := []string{commandName(p.Cmdline)}
+	for _, parent := range p.Parents {
+		names = append(names, commandName(parent))
+	}
+	return strings.Join(names, " <- ")
+}
+
+func (p *PeerCred) String() string {
+	cmdline := p.Cmdline
+	if cmdline == "" {
+		cmdline = "?"
+	}
+	return fmt.Sprintf("%s (pid %d, uid %d, %s)", cmdline, p.Pid, p.UID, p.Chain())
+}
+
+// ConnInfo - Metadata about a single client connection to the agent
+type ConnInfo struct {
+	ID   uint64
+	Conn net.Conn
+	Peer *PeerCred // nil if the peer could not be identified
+	// Why the peer could not be identified
+	PeerErr error
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mutex sync.Mutex
+	// Hosts bound with session-bind@openssh.com, one per hop when the
+	// agent is forwarded
+	binds []*sessionBind
+}
+
+// NewConnInfo - Allocate metadata for a newly accepted connection
+func NewConnInfo(conn net.Conn) *ConnInfo {
+	ctx, cancel := context.WithCancel(context.Background())
+	info := &ConnInfo{
+		ID:     atomic.AddUint64(&connCounter, 1),
+		Conn:   conn,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	info.Peer, info.PeerErr = GetPeerCred(conn)
+
+	return info
+}
+
+// Context - Done when the client has disconnected
+func (c *ConnInfo) Context() context.Context {
+	if c == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// Watch - Read from the connection in the background so the client hanging
+// up cancels the connection context, even while a Sign is in progress
+func (c *ConnInfo) Watch() io.ReadWriter {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := io.Copy(pw, c.Conn)
+		c.cancel()
+		pw.CloseWithError(err)
+	}()
+
+	return struct {
+		io.Reader
+		io.Writer
+	}{pr, c.Conn}
+}
+
+// Bind - The destination host the connection was last bound to, if any
+func (c *ConnInfo) Bind() *sessionBind {
+	if c == nil {
+		return nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.binds) == 0 {
+		return nil
+	}
+	return c.binds[len(c.binds)-1]
+}
+
+// Binds - All hosts the connection was bound to, first hop first
+func (c *ConnInfo) Binds() []*sessionBind {
+	if c == nil {
+		return nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]*sessionBind(nil), c.binds...)
+}
+
+// Forwarded - Whether the connection reaches us through agent forwarding
+func (c *ConnInfo) Forwarded() bool {
+	for _, bind := range c.Binds() {
+		if bind.forwarding {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *ConnInfo) addBind(bind *sessionBind) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.binds) >= maxSessionBinds {
+		return fmt.Errorf("agent: connection bound to more than %d hosts", maxSessionBinds)
+	}
+	c.binds = append(c.binds, bind)
+	return nil
+}
+
+func (c *ConnInfo) String() string {
+	if c == nil {
+		return "unknown connection"
+	}
+	if c.Peer == nil {
+		return fmt.Sprintf("connection #%d", c.ID)
+	}
+	return fmt.Sprintf("connection #%d from %s", c.ID, c.Peer)
+}
+
+// Details - Human readable description of who is asking for a signature
+// and where to, for use in notifications
+func (c *ConnInfo) Details() []string {
+	var details []string
+	if c == nil {
+		return details
+	}
+	if bind := c.Bind(); bind != nil {
+		details = append(details, fmt.Sprintf("Host: %s", bind))
+	}
+	if c.Peer != nil {
+		details = append(details, fmt.Sprintf("Process: %s", c.Peer.Cmdline))
+		details = append(details, fmt.Sprintf("Started by: %s", c.Peer.Chain()))
+	}
+	return details
+}
+
+// connAgent wraps the shared keyring for a single client connection and
+// carries the connection metadata into every Sign
+type connAgent struct {
+	*proxykeyring
+	conn *ConnInfo
+}
+
+// NewConnAgent - Serve conn from the shared proxy keyring
+func NewConnAgent(keyring *proxykeyring, conn *ConnInfo) agent.ExtendedAgent {
+	return &connAgent{
+		proxykeyring: keyring,
+		conn:         conn,
+	}
+}
+
+func (a *connAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return a.SignWithFlags(key, data, 0)
+}
+
+func (a *connAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	destination := "unbound session"
+	if bind := a.conn.Bind(); bind != nil {
+		destination = bind.String()
+	}
+	Audit(a.conn, "sign request for %s to %s", ssh.FingerprintSHA256(key), destination)
+
+	sig, err := a.proxykeyring.SignConn(key, data, flags, a.conn)
+	if err != nil {
+		Audit(a.conn, "sign request for %s failed: %s", ssh.FingerprintSHA256(key), err)
+		return nil, err
+	}
+
+	Audit(a.conn, "signed with %s", ssh.FingerprintSHA256(key))
+	return sig, nil
+}
+
+func (a *connAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	if isControlExtension(extensionType) && a.conn.Forwarded() {
+		Audit(a.conn, "refused %s from a forwarded connection", extensionType)
+		return nil, errForwardedControl
+	}
+
+	switch extensionType {
+	case cancelExtension:
+		Audit(a.conn, "cancelled pending requests")
+		a.tkKeyRing.CancelPending()
+		return nil, nil
+
+	case enableExtension:
+		Audit(a.conn, "re-enabled identities")
+		a.tkKeyRing.EnableAll()
+		return nil, nil
+
+	case dropExtension:
+		var req dropRequest
+		if err := ssh.Unmarshal(contents, &req); err != nil {
+			return nil, err
+		}
+		key, err := ssh.ParsePublicKey(req.Blob)
+		if err != nil {
+			return nil, err
+		}
+		// Dropping an identity the agent doesn't have is fine
+		if err := a.tkKeyRing.Drop(key); err != nil && err != ErrSignerNotFound {
+			return nil, err
+		}
+		Audit(a.conn, "dropped %s", ssh.FingerprintSHA256(key))
+		return nil, nil
+
+	case statusExtension:
+		statuses, err := a.tkKeyRing.Status()
+		if err != nil {
+			return nil, err
+		}
+		return marshalStatus(statuses), nil
+
+	case sessionBindExtension:
+		bind, err := parseSessionBind(contents)
+		if err != nil {
+			return nil, err
+		}
+		if err := a.conn.addBind(bind); err != nil {
+			return nil, err
+		}
+		Audit(a.conn, "bound to %s", bind)
+
+		// Not forwarded, the backend connection is shared by all clients
+		return nil, nil
+	}
+
+	return a.proxykeyring.Extension(extensionType, contents)
+}
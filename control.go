@@ -0,0 +1,144 @@
+/*
+Copyright 2017, Trusted Key
+This file is part of Trusted Key SSH-Agent.
+
+Trusted Key SSH-Agent is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Trusted Key SSH-Agent is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Trusted Key SSH-Agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"net"
+)
+
+// Agent extensions for controlling a running agent
+const (
+	// Abort all pending Trusted Key signature requests
+	cancelExtension = "cancel@trustedkey.com"
+	// Re-enable identities removed with ssh-add -d/-D
+	enableExtension = "enable@trustedkey.com"
+	// List Trusted Key identities, including disabled ones
+	statusExtension = "status@trustedkey.com"
+	// Forget an unenrolled identity
+	dropExtension = "drop@trustedkey.com"
+)
+
+// errForwardedControl - Hosts the agent is forwarded to may not control it
+var errForwardedControl = errors.New("agent: control requests are not accepted from forwarded connections")
+
+// isControlExtension - Whether extensionType changes or reveals agent state
+func isControlExtension(extensionType string) bool {
+	switch extensionType {
+	case cancelExtension, enableExtension, statusExtension, dropExtension:
+		return true
+	}
+	return false
+}
+
+// SSH_AGENT_SUCCESS, extension replies with data start with it
+const agentSuccess = 6
+
+// IdentityStatus - State of an identity in a running agent
+type IdentityStatus struct {
+	Blob     []byte // Public key in SSH wire format
+	Comment  string
+	Disabled bool
+}
+
+// marshalStatus - Reply to a status extension request
+func marshalStatus(statuses []IdentityStatus) []byte {
+	reply := []byte{agentSuccess}
+	for _, status := range statuses {
+		reply = append(reply, ssh.Marshal(status)...)
+	}
+	return reply
+}
+
+// parseStatus - Parse the reply to a status extension request
+func parseStatus(reply []byte) ([]IdentityStatus, error) {
+	if len(reply) == 0 || reply[0] != agentSuccess {
+		return nil, errors.New("agent: unexpected status reply")
+	}
+
+	var statuses []IdentityStatus
+	rest := reply[1:]
+	for len(rest) > 0 {
+		var msg struct {
+			Blob     []byte
+			Comment  string
+			Disabled bool
+			Rest     []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(rest, &msg); err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, IdentityStatus{
+			Blob:     msg.Blob,
+			Comment:  msg.Comment,
+			Disabled: msg.Disabled,
+		})
+		rest = msg.Rest
+	}
+	return statuses, nil
+}
+
+// controlAgent - Send an extension request to a running agent
+func controlAgent(sockPath string, extensionType string, contents []byte) error {
+	conn, err := net.Dial("unix", sockPath)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = agent.NewClient(conn).Extension(extensionType, contents)
+	return err
+}
+
+// CancelMain - Ask a running agent to cancel all pending requests
+func CancelMain(sockPath string) error {
+	return controlAgent(sockPath, cancelExtension, nil)
+}
+
+// EnableMain - Ask a running agent to re-enable removed identities
+func EnableMain(sockPath string) error {
+	return controlAgent(sockPath, enableExtension, nil)
+}
+
+// dropRequest - Contents of a drop extension request
+type dropRequest struct {
+	Blob []byte // Public key in SSH wire format
+}
+
+// DropIdentity - Ask a running agent to forget an identity
+func DropIdentity(sockPath string, key ssh.PublicKey) error {
+	return controlAgent(sockPath, dropExtension, ssh.Marshal(dropRequest{Blob: key.Marshal()}))
+}
+
+// AgentStatus - Ask a running agent which Trusted Key identities it serves
+func AgentStatus(sockPath string) ([]IdentityStatus, error) {
+	conn, err := net.Dial("unix", sockPath)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	reply, err := agent.NewClient(conn).Extension(statusExtension, nil)
+	if err != nil {
+		return nil, err
+	}
+	return parseStatus(reply)
+}
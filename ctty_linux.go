@@ -0,0 +1,101 @@
+// +build linux
+
+/*
+Copyright 2017, Trusted Key
+This file is part of Trusted Key SSH-Agent.
+
+Trusted Key SSH-Agent is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Trusted Key SSH-Agent is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Trusted Key SSH-Agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// ControllingTTY - Path of the controlling terminal of process pid
+func ControllingTTY(pid int) (string, error) {
+	fields, err := procStat(pid)
+	if err != nil {
+		return "", err
+	}
+
+	// State, ppid, pgrp and session come before the terminal device number
+	ttyNr, err := strconv.ParseUint(fields[4], 10, 64)
+	if err != nil {
+		return "", err
+	}
+	if ttyNr == 0 {
+		return "", fmt.Errorf("Process %d has no controlling terminal", pid)
+	}
+
+	// Usually one of the standard descriptors, unless they are redirected
+	var candidates []string
+	for fd := 0; fd <= 2; fd++ {
+		if target, err := os.Readlink(fmt.Sprintf("/proc/%d/fd/%d", pid, fd)); err == nil {
+			candidates = append(candidates, target)
+		}
+	}
+	if pts, err := ioutil.ReadDir("/dev/pts"); err == nil {
+		for _, entry := range pts {
+			candidates = append(candidates, filepath.Join("/dev/pts", entry.Name()))
+		}
+	}
+
+	for _, candidate := range candidates {
+		var stat syscall.Stat_t
+		if err := syscall.Stat(candidate, &stat); err != nil {
+			continue
+		}
+		// st_rdev and tty_nr use the same encoding
+		if stat.Mode&syscall.S_IFMT == syscall.S_IFCHR && uint64(stat.Rdev) == ttyNr {
+			return candidate, nil
+		}
+	}
+
+	return "", fmt.Errorf("Controlling terminal of process %d not found", pid)
+}
+
+// WriteControllingTTY - Write text to the terminal of process pid, which
+// must belong to the user running the agent
+func WriteControllingTTY(pid int, text string) error {
+	ttyPath, err := ControllingTTY(pid)
+	if err != nil {
+		return err
+	}
+
+	tty, err := os.OpenFile(ttyPath, os.O_WRONLY|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return err
+	}
+	defer tty.Close()
+
+	// Check the device we opened, not the path
+	var stat syscall.Stat_t
+	if err := syscall.Fstat(int(tty.Fd()), &stat); err != nil {
+		return err
+	}
+	if int(stat.Uid) != os.Getuid() {
+		return errors.New("Not writing to a terminal of another user")
+	}
+
+	_, err = tty.WriteString(text)
+	return err
+}
@@ -0,0 +1,607 @@
+/*
+Copyright 2017, Trusted Key
+This file is part of Trusted Key SSH-Agent.
+
+Trusted Key SSH-Agent is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Trusted Key SSH-Agent is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Trusted Key SSH-Agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Just enough of the D-Bus wire protocol to talk to the desktop
+// notification daemon and the Secret Service without linking libdbus:
+// https://dbus.freedesktop.org/doc/dbus-specification.html
+
+const dbusCallTimeout = 5 * time.Second
+
+// Message types
+const (
+	dbusMethodCall   = 1
+	dbusMethodReturn = 2
+	dbusError        = 3
+	dbusSignal       = 4
+)
+
+// Header field codes
+const (
+	dbusFieldPath        = 1
+	dbusFieldInterface   = 2
+	dbusFieldMember      = 3
+	dbusFieldErrorName   = 4
+	dbusFieldReplySerial = 5
+	dbusFieldDestination = 6
+	dbusFieldSender      = 7
+	dbusFieldSignature   = 8
+)
+
+// The spec limits messages to 128MiB
+const dbusMaxMessage = 128 * 1024 * 1024
+
+var errDBusClosed = errors.New("dbus: connection closed")
+
+// dbusEncoder - Marshals values in little endian, alignment is relative to
+// the start of buf so bodies can be encoded on their own
+type dbusEncoder struct {
+	buf []byte
+}
+
+func (e *dbusEncoder) align(n int) {
+	for len(e.buf)%n != 0 {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+func (e *dbusEncoder) byte(b byte) {
+	e.buf = append(e.buf, b)
+}
+
+func (e *dbusEncoder) uint32(v uint32) {
+	e.align(4)
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	e.buf = append(e.buf, b[:]...)
+}
+
+func (e *dbusEncoder) int32(v int32) {
+	e.uint32(uint32(v))
+}
+
+func (e *dbusEncoder) bool(v bool) {
+	if v {
+		e.uint32(1)
+	} else {
+		e.uint32(0)
+	}
+}
+
+// string - Also used for object paths
+func (e *dbusEncoder) string(s string) {
+	e.uint32(uint32(len(s)))
+	e.buf = append(e.buf, s...)
+	e.buf = append(e.buf, 0)
+}
+
+func (e *dbusEncoder) signature(s string) {
+	e.byte(byte(len(s)))
+	e.buf = append(e.buf, s...)
+	e.buf = append(e.buf, 0)
+}
+
+// byteArray - An "ay"
+func (e *dbusEncoder) byteArray(b []byte) {
+	e.uint32(uint32(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+// strings - An "as" or "ao"
+func (e *dbusEncoder) strings(values []string) {
+	e.array(4, func() {
+		for _, value := range values {
+			e.string(value)
+		}
+	})
+}
+
+// array - elements writes the array contents, aligned to alignment
+func (e *dbusEncoder) array(alignment int, elements func()) {
+	e.uint32(0)
+	lengthPos := len(e.buf) - 4
+	e.align(alignment)
+	start := len(e.buf)
+	elements()
+	binary.LittleEndian.PutUint32(e.buf[lengthPos:], uint32(len(e.buf)-start))
+}
+
+func (e *dbusEncoder) variant(signature string, value func()) {
+	e.signature(signature)
+	value()
+}
+
+// dbusDecoder - Unmarshals values, the first error sticks and makes every
+// later read return zero values
+type dbusDecoder struct {
+	buf   []byte
+	pos   int
+	order binary.ByteOrder
+	err   error
+}
+
+func (d *dbusDecoder) need(n int) bool {
+	if d.err == nil && d.pos+n > len(d.buf) {
+		d.err = errors.New("dbus: message truncated")
+	}
+	return d.err == nil
+}
+
+func (d *dbusDecoder) align(n int) {
+	padding := (n - d.pos%n) % n
+	if d.need(padding) {
+		d.pos += padding
+	}
+}
+
+func (d *dbusDecoder) byte() byte {
+	if !d.need(1) {
+		return 0
+	}
+	d.pos++
+	return d.buf[d.pos-1]
+}
+
+func (d *dbusDecoder) uint32() uint32 {
+	d.align(4)
+	if !d.need(4) {
+		return 0
+	}
+	d.pos += 4
+	return d.order.Uint32(d.buf[d.pos-4:])
+}
+
+func (d *dbusDecoder) bool() bool {
+	return d.uint32() != 0
+}
+
+func (d *dbusDecoder) bytes(n int) string {
+	// Including the terminating nul
+	if !d.need(n + 1) {
+		return ""
+	}
+	d.pos += n + 1
+	return string(d.buf[d.pos-n-1 : d.pos-1])
+}
+
+func (d *dbusDecoder) string() string {
+	return d.bytes(int(d.uint32()))
+}
+
+func (d *dbusDecoder) signature() string {
+	return d.bytes(int(d.byte()))
+}
+
+// byteArray - An "ay"
+func (d *dbusDecoder) byteArray() []byte {
+	length := int(d.uint32())
+	if !d.need(length) {
+		return nil
+	}
+	d.pos += length
+	return d.buf[d.pos-length : d.pos]
+}
+
+// strings - An "as" or "ao"
+func (d *dbusDecoder) strings() []string {
+	length := int(d.uint32())
+	d.align(4)
+	end := d.pos + length
+	var values []string
+	for d.err == nil && d.pos < end {
+		values = append(values, d.string())
+	}
+	return values
+}
+
+// variant - Only the basic types found in message headers and signals
+func (d *dbusDecoder) variant() interface{} {
+	switch signature := d.signature(); signature {
+	case "y":
+		return d.byte()
+	case "u", "i":
+		return d.uint32()
+	case "s", "o":
+		return d.string()
+	case "g":
+		return d.signature()
+	default:
+		if d.err == nil {
+			d.err = fmt.Errorf("dbus: unsupported variant type %q", signature)
+		}
+		return nil
+	}
+}
+
+// dbusMessage - A message with the header fields we care about
+type dbusMessage struct {
+	Type        byte
+	Flags       byte
+	Serial      uint32
+	ReplySerial uint32
+	Path        string
+	Interface   string
+	Member      string
+	ErrorName   string
+	Destination string
+	Sender      string
+	Signature   string
+	Body        []byte
+
+	order binary.ByteOrder
+}
+
+func (m *dbusMessage) marshal() []byte {
+	e := &dbusEncoder{}
+	e.byte('l')
+	e.byte(m.Type)
+	e.byte(m.Flags)
+	e.byte(1) // Protocol version
+	e.uint32(uint32(len(m.Body)))
+	e.uint32(m.Serial)
+
+	field := func(code byte, signature string, value string) {
+		if value == "" {
+			return
+		}
+		e.align(8)
+		e.byte(code)
+		e.variant(signature, func() {
+			if signature == "g" {
+				e.signature(value)
+			} else {
+				e.string(value)
+			}
+		})
+	}
+	e.array(8, func() {
+		field(dbusFieldPath, "o", m.Path)
+		field(dbusFieldInterface, "s", m.Interface)
+		field(dbusFieldMember, "s", m.Member)
+		field(dbusFieldErrorName, "s", m.ErrorName)
+		if m.ReplySerial != 0 {
+			e.align(8)
+			e.byte(dbusFieldReplySerial)
+			e.variant("u", func() { e.uint32(m.ReplySerial) })
+		}
+		field(dbusFieldDestination, "s", m.Destination)
+		field(dbusFieldSender, "s", m.Sender)
+		field(dbusFieldSignature, "g", m.Signature)
+	})
+	e.align(8)
+
+	return append(e.buf, m.Body...)
+}
+
+// readDBusMessage - Read one message from r
+func readDBusMessage(r io.Reader) (*dbusMessage, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+
+	var order binary.ByteOrder
+	switch fixed[0] {
+	case 'l':
+		order = binary.LittleEndian
+	case 'B':
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("dbus: invalid endianness %q", fixed[0])
+	}
+
+	bodyLength := int(order.Uint32(fixed[4:]))
+	fieldsLength := int(order.Uint32(fixed[12:]))
+	headerLength := (16 + fieldsLength + 7) &^ 7
+	if bodyLength < 0 || fieldsLength < 0 || headerLength+bodyLength > dbusMaxMessage {
+		return nil, errors.New("dbus: message too large")
+	}
+
+	buf := make([]byte, headerLength+bodyLength)
+	copy(buf, fixed)
+	if _, err := io.ReadFull(r, buf[16:]); err != nil {
+		return nil, err
+	}
+
+	m := &dbusMessage{
+		Type:   buf[1],
+		Flags:  buf[2],
+		Serial: order.Uint32(buf[8:]),
+		Body:   buf[headerLength:],
+		order:  order,
+	}
+
+	d := &dbusDecoder{buf: buf[:16+fieldsLength], pos: 16, order: order}
+	for d.err == nil && d.pos < len(d.buf) {
+		d.align(8)
+		code := d.byte()
+		value := d.variant()
+		switch v := value.(type) {
+		case string:
+			switch code {
+			case dbusFieldPath:
+				m.Path = v
+			case dbusFieldInterface:
+				m.Interface = v
+			case dbusFieldMember:
+				m.Member = v
+			case dbusFieldErrorName:
+				m.ErrorName = v
+			case dbusFieldDestination:
+				m.Destination = v
+			case dbusFieldSender:
+				m.Sender = v
+			case dbusFieldSignature:
+				m.Signature = v
+			}
+		case uint32:
+			if code == dbusFieldReplySerial {
+				m.ReplySerial = v
+			}
+		}
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	return m, nil
+}
+
+// decoder - Read the body, checking it has the expected signature
+func (m *dbusMessage) decoder(signature string) (*dbusDecoder, error) {
+	if m.Signature != signature {
+		return nil, fmt.Errorf("dbus: unexpected %s reply signature %q", m.Member, m.Signature)
+	}
+	return &dbusDecoder{buf: m.Body, order: m.order}, nil
+}
+
+// dbusConn - A connection to a message bus
+type dbusConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	writeMutex sync.Mutex
+
+	mutex    sync.Mutex
+	serial   uint32
+	calls    map[uint32]chan *dbusMessage
+	onSignal func(*dbusMessage)
+	closed   bool
+}
+
+// sessionBusSockets - Unix sockets of the session bus, in order of preference
+func sessionBusSockets() []string {
+	var sockets []string
+
+	for _, address := range strings.Split(os.Getenv("DBUS_SESSION_BUS_ADDRESS"), ";") {
+		if !strings.HasPrefix(address, "unix:") {
+			continue
+		}
+		for _, option := range strings.Split(strings.TrimPrefix(address, "unix:"), ",") {
+			parts := strings.SplitN(option, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			value, err := url.PathUnescape(parts[1])
+			if err != nil {
+				continue
+			}
+			switch parts[0] {
+			case "path":
+				sockets = append(sockets, value)
+			case "abstract":
+				sockets = append(sockets, "@"+value)
+			}
+		}
+	}
+
+	// Where systemd puts the user bus
+	if len(sockets) == 0 && os.Getenv("XDG_RUNTIME_DIR") != "" {
+		sockets = append(sockets, filepath.Join(os.Getenv("XDG_RUNTIME_DIR"), "bus"))
+	}
+
+	return sockets
+}
+
+// dialSessionBus - Connect and authenticate to the user's session bus
+func dialSessionBus() (*dbusConn, error) {
+	sockets := sessionBusSockets()
+	if len(sockets) == 0 {
+		return nil, errors.New("dbus: no session bus address")
+	}
+
+	var err error
+	for _, socket := range sockets {
+		var conn net.Conn
+		conn, err = net.DialTimeout("unix", socket, dbusCallTimeout)
+		if err != nil {
+			continue
+		}
+
+		c := &dbusConn{
+			conn:   conn,
+			reader: bufio.NewReader(conn),
+			calls:  make(map[uint32]chan *dbusMessage),
+		}
+		if err = c.auth(); err != nil {
+			conn.Close()
+			continue
+		}
+		go c.readLoop()
+
+		if _, err = c.Call("org.freedesktop.DBus", "/org/freedesktop/DBus", "org.freedesktop.DBus", "Hello", "", nil); err != nil {
+			c.Close()
+			continue
+		}
+		return c, nil
+	}
+
+	return nil, err
+}
+
+// auth - SASL EXTERNAL handshake, the bus checks our uid on the socket
+func (c *dbusConn) auth() error {
+	c.conn.SetDeadline(time.Now().Add(dbusCallTimeout))
+	defer c.conn.SetDeadline(time.Time{})
+
+	uid := hex.EncodeToString([]byte(strconv.Itoa(os.Getuid())))
+	if _, err := fmt.Fprintf(c.conn, "\x00AUTH EXTERNAL %s\r\n", uid); err != nil {
+		return err
+	}
+
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "OK ") {
+		return fmt.Errorf("dbus: authentication rejected: %s", strings.TrimSpace(line))
+	}
+
+	_, err = io.WriteString(c.conn, "BEGIN\r\n")
+	return err
+}
+
+// readLoop - Hand replies to their callers and signals to onSignal
+func (c *dbusConn) readLoop() {
+	for {
+		m, err := readDBusMessage(c.reader)
+		if err != nil {
+			c.Close()
+			return
+		}
+
+		c.mutex.Lock()
+		switch m.Type {
+		case dbusMethodReturn, dbusError:
+			if reply, ok := c.calls[m.ReplySerial]; ok {
+				delete(c.calls, m.ReplySerial)
+				reply <- m
+			}
+		case dbusSignal:
+			if onSignal := c.onSignal; onSignal != nil {
+				c.mutex.Unlock()
+				onSignal(m)
+				continue
+			}
+		}
+		c.mutex.Unlock()
+	}
+}
+
+// OnSignal - Handle signals, subscribe to them with AddMatch
+func (c *dbusConn) OnSignal(onSignal func(*dbusMessage)) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.onSignal = onSignal
+}
+
+// Call - Invoke a method and wait for the reply, D-Bus errors are returned
+// as errors
+func (c *dbusConn) Call(destination string, path string, iface string, member string, signature string, body []byte) (*dbusMessage, error) {
+	reply := make(chan *dbusMessage, 1)
+
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return nil, errDBusClosed
+	}
+	c.serial++
+	serial := c.serial
+	c.calls[serial] = reply
+	c.mutex.Unlock()
+
+	m := &dbusMessage{
+		Type:        dbusMethodCall,
+		Serial:      serial,
+		Destination: destination,
+		Path:        path,
+		Interface:   iface,
+		Member:      member,
+		Signature:   signature,
+		Body:        body,
+	}
+
+	c.writeMutex.Lock()
+	_, err := c.conn.Write(m.marshal())
+	c.writeMutex.Unlock()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	select {
+	case m, ok := <-reply:
+		if !ok {
+			return nil, errDBusClosed
+		}
+		if m.Type == dbusError {
+			if d, err := m.decoder("s"); err == nil {
+				return nil, fmt.Errorf("%s: %s", m.ErrorName, d.string())
+			}
+			return nil, errors.New(m.ErrorName)
+		}
+		return m, nil
+
+	case <-time.After(dbusCallTimeout):
+		c.mutex.Lock()
+		delete(c.calls, serial)
+		c.mutex.Unlock()
+		return nil, fmt.Errorf("dbus: %s timed out", member)
+	}
+}
+
+// AddMatch - Subscribe to the signals matching rule
+func (c *dbusConn) AddMatch(rule string) error {
+	body := &dbusEncoder{}
+	body.string(rule)
+	_, err := c.Call("org.freedesktop.DBus", "/org/freedesktop/DBus", "org.freedesktop.DBus", "AddMatch", "s", body.buf)
+	return err
+}
+
+// Close - Close the connection, pending calls fail
+func (c *dbusConn) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	for serial, reply := range c.calls {
+		close(reply)
+		delete(c.calls, serial)
+	}
+	return c.conn.Close()
+}
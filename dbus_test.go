@@ -0,0 +1,512 @@
+/*
+Copyright 2017, Trusted Key
+This file is part of Trusted Key SSH-Agent.
+
+Trusted Key SSH-Agent is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Trusted Key SSH-Agent is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Trusted Key SSH-Agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBus - A session bus with a single service behind it, handlers answer
+// method calls by "interface.member"
+type fakeBus struct {
+	t        *testing.T
+	dir      string
+	listener net.Listener
+	oldEnv   string
+
+	mutex    sync.Mutex
+	serial   uint32
+	conns    []net.Conn
+	handlers map[string]func(*dbusMessage) (string, []byte, error)
+}
+
+// newFakeBus - Listen on a temporary socket and point the session bus
+// address at it, Close restores it
+func newFakeBus(t *testing.T) *fakeBus {
+	dir, err := ioutil.TempDir("", "tk-ssh-dbus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "bus")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	b := &fakeBus{
+		t:        t,
+		dir:      dir,
+		listener: listener,
+		oldEnv:   os.Getenv("DBUS_SESSION_BUS_ADDRESS"),
+		handlers: make(map[string]func(*dbusMessage) (string, []byte, error)),
+	}
+	os.Setenv("DBUS_SESSION_BUS_ADDRESS", "unix:path="+path)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			b.mutex.Lock()
+			b.conns = append(b.conns, conn)
+			b.mutex.Unlock()
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *fakeBus) Close() {
+	os.Setenv("DBUS_SESSION_BUS_ADDRESS", b.oldEnv)
+	b.listener.Close()
+	b.mutex.Lock()
+	for _, conn := range b.conns {
+		conn.Close()
+	}
+	b.mutex.Unlock()
+	os.RemoveAll(b.dir)
+}
+
+// Handle - Answer calls of iface.member with handler, which returns the
+// signature and body of the reply
+func (b *fakeBus) Handle(iface string, member string, handler func(*dbusMessage) (string, []byte, error)) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.handlers[iface+"."+member] = handler
+}
+
+func (b *fakeBus) send(conn net.Conn, m *dbusMessage) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.serial++
+	m.Serial = b.serial
+	conn.Write(m.marshal())
+}
+
+// Emit - Send a signal to every client
+func (b *fakeBus) Emit(path string, iface string, member string, signature string, body []byte) {
+	b.mutex.Lock()
+	conns := append([]net.Conn(nil), b.conns...)
+	b.mutex.Unlock()
+	for _, conn := range conns {
+		b.send(conn, &dbusMessage{
+			Type:      dbusSignal,
+			Path:      path,
+			Interface: iface,
+			Member:    member,
+			Signature: signature,
+			Body:      body,
+		})
+	}
+}
+
+func (b *fakeBus) serve(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "\x00AUTH EXTERNAL ") {
+		conn.Close()
+		return
+	}
+	conn.Write([]byte("OK 0123456789abcdef0123456789abcdef\r\n"))
+	if line, err := reader.ReadString('\n'); err != nil || line != "BEGIN\r\n" {
+		conn.Close()
+		return
+	}
+
+	for {
+		m, err := readDBusMessage(reader)
+		if err != nil {
+			return
+		}
+		if m.Type != dbusMethodCall {
+			continue
+		}
+
+		var signature string
+		var body []byte
+		switch m.Interface + "." + m.Member {
+		case "org.freedesktop.DBus.Hello":
+			e := &dbusEncoder{}
+			e.string(":1.1")
+			signature, body = "s", e.buf
+		case "org.freedesktop.DBus.AddMatch":
+		default:
+			b.mutex.Lock()
+			handler := b.handlers[m.Interface+"."+m.Member]
+			b.mutex.Unlock()
+			if handler == nil {
+				err = errors.New("org.freedesktop.DBus.Error.UnknownMethod")
+			} else {
+				signature, body, err = handler(m)
+			}
+		}
+
+		reply := &dbusMessage{
+			Type:        dbusMethodReturn,
+			ReplySerial: m.Serial,
+			Signature:   signature,
+			Body:        body,
+		}
+		if err != nil {
+			e := &dbusEncoder{}
+			e.string("failed")
+			reply.Type = dbusError
+			reply.ErrorName = err.Error()
+			reply.Signature = "s"
+			reply.Body = e.buf
+		}
+		b.send(conn, reply)
+	}
+}
+
+// readStringMap - Decode an a{ss}
+func readStringMap(d *dbusDecoder) map[string]string {
+	values := make(map[string]string)
+	length := int(d.uint32())
+	d.align(8)
+	end := d.pos + length
+	for d.err == nil && d.pos < end {
+		d.align(8)
+		key := d.string()
+		values[key] = d.string()
+	}
+	return values
+}
+
+func TestDBusMessageRoundTrip(t *testing.T) {
+	body := &dbusEncoder{}
+	body.string("app")
+	body.uint32(7)
+	body.strings([]string{"cancel", "Cancel"})
+	body.bool(true)
+	body.byteArray([]byte{1, 2, 3})
+
+	sent := &dbusMessage{
+		Type:        dbusMethodCall,
+		Flags:       1,
+		Serial:      3,
+		ReplySerial: 2,
+		Path:        "/org/example/Path",
+		Interface:   "org.example.Interface",
+		Member:      "Member",
+		ErrorName:   "org.example.Error",
+		Destination: "org.example",
+		Sender:      ":1.5",
+		Signature:   "suasbay",
+		Body:        body.buf,
+	}
+	received, err := readDBusMessage(bytes.NewReader(sent.marshal()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	received.order = nil
+	if !reflect.DeepEqual(sent, received) {
+		t.Fatalf("expected %+v, got %+v", sent, received)
+	}
+
+	received, _ = readDBusMessage(bytes.NewReader(sent.marshal()))
+	d, err := received.decoder("suasbay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app, number, actions, flag, data := d.string(), d.uint32(), d.strings(), d.bool(), d.byteArray()
+	if d.err != nil {
+		t.Fatal(d.err)
+	}
+	if app != "app" || number != 7 || !reflect.DeepEqual(actions, []string{"cancel", "Cancel"}) || !flag || !bytes.Equal(data, []byte{1, 2, 3}) {
+		t.Errorf("unexpected body %q %d %q %v %v", app, number, actions, flag, data)
+	}
+
+	if _, err := received.decoder("s"); err == nil {
+		t.Error("expected a signature mismatch error")
+	}
+}
+
+func TestReadDBusMessageBigEndian(t *testing.T) {
+	var fields bytes.Buffer
+	field := func(code byte, signature string, value string) {
+		for fields.Len()%8 != 0 {
+			fields.WriteByte(0)
+		}
+		fields.Write([]byte{code, 1, signature[0], 0})
+		if signature == "g" {
+			fields.WriteByte(byte(len(value)))
+		} else {
+			binary.Write(&fields, binary.BigEndian, uint32(len(value)))
+		}
+		fields.WriteString(value)
+		fields.WriteByte(0)
+	}
+	field(dbusFieldPath, "o", notificationsPath)
+	field(dbusFieldInterface, "s", notificationsInterface)
+	field(dbusFieldMember, "s", "NotificationClosed")
+	field(dbusFieldSignature, "g", "uu")
+
+	var message bytes.Buffer
+	message.Write([]byte{'B', dbusSignal, 0, 1})
+	binary.Write(&message, binary.BigEndian, uint32(8))
+	binary.Write(&message, binary.BigEndian, uint32(9))
+	binary.Write(&message, binary.BigEndian, uint32(fields.Len()))
+	message.Write(fields.Bytes())
+	for message.Len()%8 != 0 {
+		message.WriteByte(0)
+	}
+	binary.Write(&message, binary.BigEndian, uint32(42))
+	binary.Write(&message, binary.BigEndian, uint32(2))
+
+	m, err := readDBusMessage(&message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Type != dbusSignal || m.Serial != 9 || m.Path != notificationsPath || m.Interface != notificationsInterface || m.Member != "NotificationClosed" {
+		t.Fatalf("unexpected header %+v", m)
+	}
+	d, err := m.decoder("uu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, reason := d.uint32(), d.uint32(); id != 42 || reason != 2 || d.err != nil {
+		t.Errorf("expected 42 2, got %d %d %v", id, reason, d.err)
+	}
+}
+
+func TestReadDBusMessageTruncated(t *testing.T) {
+	body := &dbusEncoder{}
+	body.string("hello")
+	data := (&dbusMessage{Type: dbusSignal, Serial: 1, Path: "/", Member: "Test", Signature: "s", Body: body.buf}).marshal()
+
+	if _, err := readDBusMessage(bytes.NewReader(data[:len(data)-1])); err == nil {
+		t.Error("expected a short message to fail")
+	}
+
+	// The path header field claims to be longer than the header
+	corrupt := append([]byte(nil), data...)
+	binary.LittleEndian.PutUint32(corrupt[20:], 0xffff)
+	if _, err := readDBusMessage(bytes.NewReader(corrupt)); err == nil || !strings.Contains(err.Error(), "truncated") {
+		t.Errorf("expected a truncated header error, got %v", err)
+	}
+
+	// Decoding more than the body holds
+	m, err := readDBusMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, _ := m.decoder("s")
+	d.string()
+	d.uint32()
+	if d.err == nil || !strings.Contains(d.err.Error(), "truncated") {
+		t.Errorf("expected a truncated body error, got %v", d.err)
+	}
+
+	corrupt = append([]byte(nil), data...)
+	corrupt[0] = 'x'
+	if _, err := readDBusMessage(bytes.NewReader(corrupt)); err == nil {
+		t.Error("expected an invalid endianness error")
+	}
+}
+
+// fakeNotifications - A notification daemon recording what was shown
+type fakeNotifications struct {
+	bus *fakeBus
+
+	mutex  sync.Mutex
+	shown  []fakeNotification
+	closed []uint32
+}
+
+type fakeNotification struct {
+	replacesID    uint32
+	text          string
+	actions       []string
+	expireTimeout int32
+}
+
+func newFakeNotifications(t *testing.T, capabilities []string) *fakeNotifications {
+	n := &fakeNotifications{bus: newFakeBus(t)}
+
+	n.bus.Handle(notificationsInterface, "GetCapabilities", func(m *dbusMessage) (string, []byte, error) {
+		e := &dbusEncoder{}
+		e.strings(capabilities)
+		return "as", e.buf, nil
+	})
+
+	n.bus.Handle(notificationsInterface, "Notify", func(m *dbusMessage) (string, []byte, error) {
+		d, err := m.decoder("susssasa{sv}i")
+		if err != nil {
+			return "", nil, err
+		}
+		var shown fakeNotification
+		d.string()
+		shown.replacesID = d.uint32()
+		d.string()
+		d.string()
+		shown.text = d.string()
+		shown.actions = d.strings()
+		hints := int(d.uint32())
+		d.align(8)
+		d.pos += hints
+		shown.expireTimeout = int32(d.uint32())
+		if d.err != nil {
+			return "", nil, d.err
+		}
+
+		n.mutex.Lock()
+		defer n.mutex.Unlock()
+		n.shown = append(n.shown, shown)
+		e := &dbusEncoder{}
+		e.uint32(42)
+		return "u", e.buf, nil
+	})
+
+	n.bus.Handle(notificationsInterface, "CloseNotification", func(m *dbusMessage) (string, []byte, error) {
+		d, err := m.decoder("u")
+		if err != nil {
+			return "", nil, err
+		}
+		n.mutex.Lock()
+		defer n.mutex.Unlock()
+		n.closed = append(n.closed, d.uint32())
+		return "", nil, nil
+	})
+
+	return n
+}
+
+// signal - Emit a notification signal with the id and a string or uint32
+func (n *fakeNotifications) signal(member string, id uint32, value interface{}) {
+	e := &dbusEncoder{}
+	e.uint32(id)
+	signature := "uu"
+	switch v := value.(type) {
+	case string:
+		e.string(v)
+		signature = "us"
+	case uint32:
+		e.uint32(v)
+	}
+	n.bus.Emit(notificationsPath, notificationsInterface, member, signature, e.buf)
+}
+
+func TestNotifyDBusCancel(t *testing.T) {
+	fake := newFakeNotifications(t, []string{"actions", "body", "body-markup"})
+	defer fake.bus.Close()
+
+	cancelled := make(chan bool, 2)
+	n, err := notifyDBus("tk-ssh-agent", "Login to <host>?", "1234", func() { cancelled <- true })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake.mutex.Lock()
+	shown := fake.shown
+	fake.mutex.Unlock()
+	expected := []fakeNotification{{text: "Login to &lt;host&gt;? \nCode: 1234", actions: []string{"cancel", "Cancel"}}}
+	if !reflect.DeepEqual(shown, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, shown)
+	}
+
+	// Someone else's notification
+	fake.signal("ActionInvoked", 41, "cancel")
+	fake.signal("ActionInvoked", 42, "cancel")
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("cancel wasn't run")
+	}
+	select {
+	case <-cancelled:
+		t.Fatal("cancel was run for another notification")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	n.Done(false)
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	if !reflect.DeepEqual(fake.closed, []uint32{42}) {
+		t.Errorf("expected the notification to be closed, got %v", fake.closed)
+	}
+}
+
+func TestNotifyDBusApproved(t *testing.T) {
+	fake := newFakeNotifications(t, nil)
+	defer fake.bus.Close()
+
+	n, err := notifyDBus("tk-ssh-agent", "Login to <host>?", "", func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Done(true)
+
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	// No markup or actions without the capabilities
+	expected := []fakeNotification{
+		{text: "Login to <host>?"},
+		{replacesID: 42, text: "SSH login approved", expireTimeout: notificationOutcomeTimeout},
+	}
+	if !reflect.DeepEqual(fake.shown, expected) {
+		t.Errorf("expected %+v, got %+v", expected, fake.shown)
+	}
+}
+
+func TestNotifyDBusClosedByUser(t *testing.T) {
+	fake := newFakeNotifications(t, []string{"actions"})
+	defer fake.bus.Close()
+
+	n, err := notifyDBus("tk-ssh-agent", "Login?", "", func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.signal("NotificationClosed", 42, uint32(2))
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		n.mutex.Lock()
+		closed := n.closed
+		n.mutex.Unlock()
+		if closed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the notification wasn't marked closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	n.Done(true)
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	if len(fake.shown) != 1 || len(fake.closed) != 0 {
+		t.Errorf("expected no outcome for a dismissed notification, got %+v, closed %v", fake.shown, fake.closed)
+	}
+}
@@ -19,45 +19,52 @@ along with Trusted Key SSH-Agent.  If not, see <http://www.gnu.org/licenses/>.
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"golang.org/x/crypto/ssh"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
 	"os"
-	"os/user"
-	"path"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
 )
 
-func getLoginQueryParams(rpURL string, client *http.Client) (string, string, error) {
+// getLoginQueryParams - Start a login on the relying party, returns the
+// wallet URL, the login query and the full wallet login URL
+func getLoginQueryParams(ctx context.Context, rpURL string, client *http.Client) (string, string, string, error) {
 	req, err := http.NewRequest("GET", fmt.Sprintf("%s/login/trustedkey/", rpURL), nil)
 	if err != nil {
-		return "", "", err
+		return "", "", "", err
 	}
 
-	resp, err := client.Do(req)
+	resp, err := client.Do(req.WithContext(ctx))
 	if err != nil {
-		return "", "", err
+		return "", "", "", err
 	}
 	defer resp.Body.Close()
 
 	location := resp.Header.Get("Location")
 	if location == "" {
-		return "", "", errors.New("Missing location header")
+		return "", "", "", errors.New("Missing location header")
 	}
 
 	url, err := url.ParseRequestURI(location)
 	if err != nil {
-		return "", "", err
+		return "", "", "", err
 	}
 
-	return fmt.Sprintf("%s://%s", url.Scheme, url.Host), url.RawQuery, nil
+	return fmt.Sprintf("%s://%s", url.Scheme, url.Host), url.RawQuery, location, nil
 }
 
-func submitLogin(walletURL string, username string, queryParams string) (map[string]string, error) {
+func submitLogin(ctx context.Context, walletURL string, username string, queryParams string) (map[string]string, error) {
 	walletSubmitURL, err := url.ParseRequestURI(fmt.Sprintf("%s/oauth/IDentify/submitLogin", walletURL))
 	if err != nil {
 		return nil, err
@@ -68,7 +75,13 @@ func submitLogin(walletURL string, username string, queryParams string) (map[str
 	q.Set("username", username)
 	walletSubmitURL.RawQuery = q.Encode()
 
-	resp, err := http.Get(walletSubmitURL.String())
+	req, err := http.NewRequest("GET", walletSubmitURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: enrollRequestTimeout}
+	resp, err := client.Do(req.WithContext(ctx))
 	if err != nil {
 		return nil, err
 	}
@@ -88,68 +101,130 @@ func submitLogin(walletURL string, username string, queryParams string) (map[str
 		return nil, err
 	}
 
+	data, _ := jsonData["data"].(map[string]interface{})
+	nonce, _ := data["nonce"].(string)
+	checksum, _ := data["checksum"].(string)
+	if nonce == "" || checksum == "" {
+		return nil, errors.New("Unexpected response from wallet (missing nonce or checksum)")
+	}
+
 	ret := make(map[string]string)
-	data := jsonData["data"].(map[string]interface{})
-	ret["nonce"] = data["nonce"].(string)
-	ret["checksum"] = data["checksum"].(string)
+	ret["nonce"] = nonce
+	ret["checksum"] = checksum
 
 	return ret, nil
 }
 
-func waitLogin(walletURL string, nonce string) (string, error) {
-	waitURL, err := url.ParseRequestURI(fmt.Sprintf("%s/oauth/IDentify/waitLogin", walletURL))
+// walletLoginNonce - Nonce of the login request in the wallet login URL, for
+// waiting on a login started by scanning the URL
+func walletLoginNonce(walletLoginURL string) (string, error) {
+	loginURL, err := url.Parse(walletLoginURL)
 	if err != nil {
 		return "", err
 	}
+	nonce := loginURL.Query().Get("nonce")
+	if nonce == "" {
+		return "", errors.New("The login request of the relying party has no nonce to wait for, enroll with --email instead of --qr")
+	}
+	return nonce, nil
+}
 
-	q := waitURL.Query()
-	q.Set("nonce", nonce)
-	waitURL.RawQuery = q.Encode()
+// ErrLoginRejected - The user rejected the enrollment in the app
+var ErrLoginRejected = errors.New("The login request was rejected in the Trusted Key App")
 
-	resp, err := http.Get(waitURL.String())
+// waitLoginOnce - Long-poll the wallet for the login result
+func waitLoginOnce(ctx context.Context, waitURL string) (int, []byte, error) {
+	req, err := http.NewRequest("GET", waitURL, nil)
 	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	// Timeout, retry
-	if resp.StatusCode == 408 {
-		return waitLogin(walletURL, nonce)
+		return 0, nil, err
 	}
 
-	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("Server returned HTTP status code %d", resp.StatusCode)
+	// No client timeout, the wallet holds on to the request until the
+	// login is answered
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, nil, err
 	}
+	defer resp.Body.Close()
 
 	body, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, body, err
+}
+
+// waitLogin - Wait until the user approved the login in the app, the
+// request was rejected or ctx is done
+func waitLogin(ctx context.Context, walletURL string, nonce string, out io.Writer) (string, error) {
+	waitURL, err := url.ParseRequestURI(fmt.Sprintf("%s/oauth/IDentify/waitLogin", walletURL))
 	if err != nil {
 		return "", err
 	}
 
-	var jsonData map[string]interface{}
-	if err := json.Unmarshal(body, &jsonData); err != nil {
-		return "", err
-	}
+	q := waitURL.Query()
+	q.Set("nonce", nonce)
+	waitURL.RawQuery = q.Encode()
+
+	deadline, _ := ctx.Deadline()
+	stopSpinner := startSpinner(out, "Waiting for approval in the Trusted Key App", deadline)
+	defer stopSpinner()
+
+	for attempt := 0; ; attempt++ {
+		started := time.Now()
+		statusCode, body, err := waitLoginOnce(ctx, waitURL.String())
+		if ctx.Err() != nil {
+			return "", enrollContextError(ctx)
+		}
+		if err != nil {
+			return "", err
+		}
+
+		switch statusCode {
+		case 200:
+		case 408:
+			// The long poll expired, don't hammer servers answering right away
+			if time.Since(started) < time.Second {
+				select {
+				case <-time.After(backoff(attempt)):
+				case <-ctx.Done():
+					return "", enrollContextError(ctx)
+				}
+			}
+			continue
+		case 401, 403, 410:
+			return "", &EnrollError{Code: exitEnrollRejected, Err: ErrLoginRejected}
+		default:
+			return "", fmt.Errorf("Server returned HTTP status code %d", statusCode)
+		}
 
-	data := jsonData["data"].(map[string]interface{})
+		var jsonData map[string]interface{}
+		if err := json.Unmarshal(body, &jsonData); err != nil {
+			return "", err
+		}
+
+		data, _ := jsonData["data"].(map[string]interface{})
+		loginURL, _ := data["url"].(string)
+		if loginURL == "" {
+			return "", errors.New("Unexpected response from wallet (missing login URL)")
+		}
 
-	return data["url"].(string), nil
+		return loginURL, nil
+	}
 }
 
-func getCredentialConfig(rpURL string, client *http.Client) (map[string]interface{}, error) {
+func getCredentialConfig(ctx context.Context, rpURL string, client *http.Client) (map[string]interface{}, error) {
 	req, err := http.NewRequest("GET", fmt.Sprintf("%s/credential_add", rpURL), nil)
 	if err != nil {
 		return nil, err
 	}
 
-	resp, err := client.Do(req)
+	resp, err := client.Do(req.WithContext(ctx))
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("Server returned HTTP status code %d (login not successful)", resp.StatusCode)
+		return nil, &EnrollError{Code: exitEnrollRejected,
+			Err: fmt.Errorf("Server returned HTTP status code %d (login not successful)", resp.StatusCode)}
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
@@ -165,7 +240,11 @@ func getCredentialConfig(rpURL string, client *http.Client) (map[string]interfac
 	return data, nil
 }
 
-func login(username string, rpURL string) (map[string]interface{}, error) {
+// login - Log in to the relying party through the wallet and fetch new
+// credentials, messages for the user are written to out. The login request
+// is sent to the app signed in as username, or with qrCode the wallet login
+// URL is shown as a QR code to scan instead.
+func login(ctx context.Context, username string, rpURL string, qrCode bool, out io.Writer) (map[string]interface{}, error) {
 	cookiejar, err := cookiejar.New(nil)
 	if err != nil {
 		return nil, err
@@ -175,118 +254,520 @@ func login(username string, rpURL string) (map[string]interface{}, error) {
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse
 		},
-		Jar: cookiejar,
+		Jar:     cookiejar,
+		Timeout: enrollRequestTimeout,
 	}
 
-	walletURL, queryParams, err := getLoginQueryParams(rpURL, client)
-	if err != nil {
-		return nil, err
+	// Ctrl-C or the timeout, rather than whatever the request failed with
+	failed := func(err error) error {
+		if ctx.Err() != nil {
+			return enrollContextError(ctx)
+		}
+		return err
 	}
 
-	loginData, err := submitLogin(walletURL, username, queryParams)
+	walletURL, queryParams, walletLoginURL, err := getLoginQueryParams(ctx, rpURL, client)
 	if err != nil {
-		return nil, err
+		return nil, failed(err)
 	}
 
-	fmt.Println(fmt.Sprintf("Verify SSH Login request on your Trusted Key App. Code: %s", loginData["checksum"]))
+	// The relying party has a session for us from here on, end it if we give up
+	var nonce string
+	if qrCode {
+		// Whoever scans the code logs in, there is no email address to
+		// send the request to
+		nonce, err = walletLoginNonce(walletLoginURL)
+		if err != nil {
+			logout(rpURL, client)
+			return nil, err
+		}
+		printLoginQRCode(out, walletLoginURL)
+	} else {
+		loginData, err := submitLogin(ctx, walletURL, username, queryParams)
+		if err != nil {
+			logout(rpURL, client)
+			return nil, failed(err)
+		}
+		nonce = loginData["nonce"]
+		fmt.Fprintln(out, fmt.Sprintf("Verify SSH Login request on your Trusted Key App. Code: %s", loginData["checksum"]))
+	}
 
-	loginURL, err := waitLogin(walletURL, loginData["nonce"])
+	loginURL, err := waitLogin(ctx, walletURL, nonce, out)
 	if err != nil {
+		logout(rpURL, client)
 		return nil, err
 	}
 
+	defer logout(rpURL, client)
+
 	req, err := http.NewRequest("GET", loginURL, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	resp, err := client.Do(req)
+	resp, err := client.Do(req.WithContext(ctx))
 	if err != nil {
-		return nil, err
+		return nil, failed(err)
 	}
-	defer resp.Body.Close()
-	defer logout(rpURL, client)
+	resp.Body.Close()
 
-	credentials, err := getCredentialConfig(rpURL, client)
+	credentials, err := getCredentialConfig(ctx, rpURL, client)
 	if err != nil {
-		return nil, err
+		return nil, failed(err)
 	}
 
 	return credentials, nil
 }
 
+// logout - End the session on the relying party, also after ctx of the
+// login was cancelled
 func logout(rpURL string, client *http.Client) {
 	req, err := http.NewRequest("GET", fmt.Sprintf("%s/logout", rpURL), nil)
 	if err != nil {
 		return
 	}
 
-	resp, err := client.Do(req)
+	ctx, cancel := context.WithTimeout(context.Background(), enrollLogoutTimeout)
+	defer cancel()
+	resp, err := client.Do(req.WithContext(ctx))
 	if err != nil {
 		return
 	}
 	defer resp.Body.Close()
 }
 
-// EnrollMain - Run enroll main loop
-func EnrollMain(username string, rpURLFlag string, configPath string) {
+// Exit codes of enroll, 2 is used by the flag package for usage errors
+const (
+	exitEnrollFailed    = 1 // Anything not covered below
+	exitEnrollUsage     = 2 // Missing or invalid arguments
+	exitEnrollConfig    = 3 // Reading or writing the config file
+	exitEnrollNetwork   = 4 // Talking to the relying party or wallet
+	exitEnrollRejected  = 5 // The login was not approved
+	exitEnrollSecrets   = 6 // Storing the client secret
+	exitEnrollPubKey    = 7 // Writing the public key file
+	exitEnrollTimeout   = 8 // The login wasn't approved in time
+	exitEnrollSSHConfig = 9 // Updating ~/.ssh/config
+
+	// Interrupted with Ctrl-C, like shells report SIGINT
+	exitEnrollCancelled = 130
+)
+
+// Default for how long enroll waits for the login to be approved
+const defaultEnrollTimeout = 5 * time.Minute
+
+// How long each request to the relying party and wallet may take, except
+// waiting for the login, and logging out when giving up
+const (
+	enrollRequestTimeout = 30 * time.Second
+	enrollLogoutTimeout  = 5 * time.Second
+)
+
+var enrollErrorClasses = map[int]string{
+	exitEnrollFailed:    "failed",
+	exitEnrollUsage:     "usage",
+	exitEnrollConfig:    "config",
+	exitEnrollNetwork:   "network",
+	exitEnrollRejected:  "rejected",
+	exitEnrollSecrets:   "secrets",
+	exitEnrollPubKey:    "pubkey",
+	exitEnrollTimeout:   "timeout",
+	exitEnrollSSHConfig: "ssh-config",
+
+	exitEnrollCancelled: "cancelled",
+}
+
+// EnrollError - An enroll failure with the exit code for its class
+type EnrollError struct {
+	Code int
+	Err  error
+}
+
+func (e *EnrollError) Error() string {
+	return e.Err.Error()
+}
+
+// Class - Short name of the failure class, e.g. "network"
+func (e *EnrollError) Class() string {
+	return enrollErrorClasses[e.Code]
+}
+
+// enrollContextError - Why ctx is done, as an EnrollError
+func enrollContextError(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return &EnrollError{Code: exitEnrollTimeout, Err: errors.New("Timed out waiting for approval in the Trusted Key App")}
+	}
+	return &EnrollError{Code: exitEnrollCancelled, Err: errors.New("Enrollment cancelled")}
+}
+
+func enrollError(code int, err error) error {
+	if _, ok := err.(*EnrollError); ok {
+		return err
+	}
+	return &EnrollError{Code: code, Err: err}
+}
+
+const defaultRpURL = "https://ssh.trustedkey.com"
+
+// EnrollOptions - Arguments of enroll
+type EnrollOptions struct {
+	Username    string
+	RpURL       string // Empty for the profile's or the default
+	ConfigPath  string
+	Profile     string // Add the new identities to this profile if not empty
+	SecretStore string
+	PubKeyDir   string // Empty for ~/.ssh
+	WritePubKey bool
+	Timeout     time.Duration // How long to wait for approval, zero for the default
+	QRCode      bool          // Log in by scanning a QR code instead of by Username
+
+	// Also write the public keys in these formats (rfc4716, pkcs8)
+	ExportFormats []string
+	// Maintain a block in ~/.ssh/config using the identities for these host patterns
+	SSHConfigHosts []string
+	SSHConfigPath  string // Empty for ~/.ssh/config
+}
+
+// EnrolledIdentity - An identity added by enroll
+type EnrolledIdentity struct {
+	Address       string `json:"address"`
+	PublicKey     string `json:"publicKey"`
+	RpURL         string `json:"rpURL"`
+	SHA256        string `json:"sha256"`
+	AuthorizedKey string `json:"authorizedKey"`
+	PubKeyFile    string `json:"pubkeyFile,omitempty"`
+}
+
+// EnrollResult - Outcome of enroll, as printed by enroll --json
+type EnrollResult struct {
+	Status     string             `json:"status"` // "enrolled" or "failed"
+	Identities []EnrolledIdentity `json:"identities"`
+	Files      []string           `json:"files"` // Files written
+	Error      string             `json:"error,omitempty"`
+	ErrorClass string             `json:"errorClass,omitempty"`
+}
+
+// Enroll - Log in to the relying party and store the credentials it issues,
+// messages for the user are written to out
+func Enroll(options EnrollOptions, out io.Writer) (*EnrollResult, error) {
+	result := &EnrollResult{
+		Status:     "failed",
+		Identities: []EnrolledIdentity{},
+		Files:      []string{},
+	}
+
+	if options.Username == "" && !options.QRCode {
+		return result, enrollError(exitEnrollUsage, errors.New("Missing email address"))
+	}
+	if options.Username != "" && options.QRCode {
+		return result, enrollError(exitEnrollUsage, errors.New("Use either --email or --qr"))
+	}
+	if options.Profile != "" {
+		if err := ValidateProfileName(options.Profile); err != nil {
+			return result, enrollError(exitEnrollUsage, err)
+		}
+	}
+	if options.SecretStore == "" {
+		options.SecretStore = defaultSecretStore()
+	}
+	switch options.SecretStore {
+	case secretStorePassphrase, secretStoreSecretService, secretStorePlaintext:
+	default:
+		return result, enrollError(exitEnrollUsage, fmt.Errorf("Unknown secret store %q", options.SecretStore))
+	}
+	for _, format := range options.ExportFormats {
+		if format != exportRFC4716 && format != exportPKCS8 {
+			return result, enrollError(exitEnrollUsage, fmt.Errorf("Unknown export format %q, expected %s or %s", format, exportRFC4716, exportPKCS8))
+		}
+	}
+	if !options.WritePubKey && (len(options.ExportFormats) > 0 || len(options.SSHConfigHosts) > 0) {
+		return result, enrollError(exitEnrollUsage, errors.New("Exporting keys and updating the ssh config need the public key files"))
+	}
+
+	config, err := ReadConfigFile(options.ConfigPath)
+	if err != nil {
+		return result, enrollError(exitEnrollConfig, err)
+	}
+
+	// Flag (or TK_SSH_RP_URL) > profile > default
+	rpURLFlag := options.RpURL
+	if rpURLFlag == "" {
+		rpURLFlag = config.ProfileRpURL(options.Profile, defaultRpURL)
+	}
+
 	// Normalise relying party URL
 	rpURL, err := url.ParseRequestURI(rpURLFlag)
+	if err != nil || rpURL.Host == "" {
+		return result, enrollError(exitEnrollUsage, fmt.Errorf("Invalid relying party URL %q", rpURLFlag))
+	}
+
+	// Profiles that don't exist yet are created below
+	selected := config
+	if config.Profiles[options.Profile] != nil {
+		selected, err = config.Select(options.Profile)
+		if err != nil {
+			return result, enrollError(exitEnrollConfig, err)
+		}
+	}
+	settings, err := selected.EffectiveSettings()
 	if err != nil {
-		panic(err)
+		return result, enrollError(exitEnrollConfig, err)
+	}
+	secrets := NewSecrets()
+	secrets.SetPassphraseCommand(settings.PassphraseCommand)
+
+	pubKeyDir := options.PubKeyDir
+	if pubKeyDir == "" && options.WritePubKey {
+		pubKeyDir, err = DefaultPubKeyDir()
+		if err != nil {
+			return result, enrollError(exitEnrollPubKey, err)
+		}
+	}
+	// Recorded in the config for unenroll
+	if pubKeyDir != "" {
+		pubKeyDir, err = filepath.Abs(pubKeyDir)
+		if err != nil {
+			return result, enrollError(exitEnrollPubKey, err)
+		}
+	}
+
+	timeout := options.Timeout
+	if timeout <= 0 {
+		timeout = defaultEnrollTimeout
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	config := ReadConfigRaw(configPath)
+	// Ctrl-C stops waiting and logs out of the relying party, only while
+	// waiting so it still interrupts the passphrase prompt below
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-interrupt:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
 
-	credentials, err := login(username, fmt.Sprintf("%s://%s", rpURL.Scheme, rpURL.Host))
+	rpOrigin := fmt.Sprintf("%s://%s", rpURL.Scheme, rpURL.Host)
+	credentials, err := login(ctx, options.Username, rpOrigin, options.QRCode, out)
+	signal.Stop(interrupt)
 	if err != nil {
-		panic(err)
+		return result, enrollError(exitEnrollNetwork, err)
+	}
+
+	var keys []string
+	for k := range credentials {
+		keys = append(keys, k)
 	}
+	sort.Strings(keys)
+
+	// Secret Service items nothing would point to if enrolling fails later
+	committed := false
+	var storedSecrets []string
+	defer func() {
+		if committed {
+			return
+		}
+		for _, clientID := range storedSecrets {
+			if err := secretServiceDelete(clientID); err != nil {
+				fmt.Fprintln(out, err)
+			}
+		}
+	}()
 
-	for k, v := range credentials {
+	for _, k := range keys {
 		pubkeyBytes := []byte(k)
 
 		addr, err := UserPubKeyHexToAddress(pubkeyBytes)
 		if err != nil {
-			panic(err)
+			return result, enrollError(exitEnrollNetwork, fmt.Errorf("Invalid public key from relying party: %s", err))
 		}
-
 		key, err := UserPubKeyHexToSSHPubKey(pubkeyBytes)
 		if err != nil {
-			panic(err)
+			return result, enrollError(exitEnrollNetwork, fmt.Errorf("Invalid public key from relying party: %s", err))
+		}
+		authorizedKey, err := UserPubKeyHexToAuthorizedKey(pubkeyBytes)
+		if err != nil {
+			return result, enrollError(exitEnrollNetwork, err)
 		}
 
-		pub := ssh.MarshalAuthorizedKey(key)
+		identityJSON, err := json.Marshal(credentials[k])
 		if err != nil {
-			panic(err)
+			return result, enrollError(exitEnrollNetwork, err)
+		}
+		identity := &IdentityConfig{}
+		if err := json.Unmarshal(identityJSON, identity); err != nil {
+			return result, enrollError(exitEnrollNetwork, fmt.Errorf("Unexpected credentials from relying party: %s", err))
 		}
+		enrolled := time.Now().UTC().Truncate(time.Second)
+		identity.Enrolled = &enrolled
 
-		usr, err := user.Current()
+		err = secrets.Store(config, k, identity, options.SecretStore)
 		if err != nil {
-			panic(err)
+			return result, enrollError(exitEnrollSecrets, err)
+		}
+		if identity.SecretService {
+			storedSecrets = append(storedSecrets, identity.ClientID)
+		}
+		config.Identities[k] = identity
+
+		if options.Profile != "" {
+			if config.Profiles == nil {
+				config.Profiles = make(map[string]*Profile)
+			}
+			if config.Profiles[options.Profile] == nil {
+				config.Profiles[options.Profile] = &Profile{RpURL: rpOrigin}
+			}
+			config.Profiles[options.Profile].Add(k, identity)
 		}
 
-		homeDirSSH := path.Join(usr.HomeDir, ".ssh")
-		if _, err := os.Stat(homeDirSSH); os.IsNotExist(err) {
-			os.Mkdir(homeDirSSH, 0700)
+		result.Identities = append(result.Identities, EnrolledIdentity{
+			Address:       addr,
+			PublicKey:     k,
+			RpURL:         identity.RpURL,
+			SHA256:        ssh.FingerprintSHA256(key),
+			AuthorizedKey: authorizedKey,
+		})
+	}
+
+	// The config is written last, nothing is enrolled if anything before fails
+	if options.WritePubKey {
+		if err := os.MkdirAll(pubKeyDir, 0700); err != nil {
+			return result, enrollError(exitEnrollPubKey, err)
+		}
+		for i, identity := range result.Identities {
+			identityConfig := config.Identities[identity.PublicKey]
+			outFile := PubKeyFile(pubKeyDir, identity.Address)
+			err = ioutil.WriteFile(outFile, []byte(identity.AuthorizedKey), 0666)
+			if err != nil {
+				return result, enrollError(exitEnrollPubKey, fmt.Errorf("Couldn't write public key file: %s", err))
+			}
+			result.Identities[i].PubKeyFile = outFile
+			result.Files = append(result.Files, outFile)
+			identityConfig.PubKeyFile = outFile
+
+			key, err := UserPubKeyHexToSSHPubKey([]byte(identity.PublicKey))
+			if err != nil {
+				return result, enrollError(exitEnrollPubKey, err)
+			}
+			for _, format := range options.ExportFormats {
+				exported, err := ExportPublicKey(key, identity.Address, format)
+				if err != nil {
+					return result, enrollError(exitEnrollPubKey, err)
+				}
+				exportFile := ExportFile(pubKeyDir, identity.Address, format)
+				if err := ioutil.WriteFile(exportFile, exported, 0666); err != nil {
+					return result, enrollError(exitEnrollPubKey, fmt.Errorf("Couldn't write public key file: %s", err))
+				}
+				result.Files = append(result.Files, exportFile)
+				identityConfig.ExportFiles = append(identityConfig.ExportFiles, exportFile)
+			}
 		}
+	}
 
-		authorizedKey := fmt.Sprintf("%s %s", string(pub[:len(pub)-1]), string(addr))
-		outFile := path.Join(homeDirSSH, fmt.Sprintf("tk_%s.pub", string(addr)))
-		err = ioutil.WriteFile(outFile, []byte(authorizedKey), 0666)
+	if len(options.SSHConfigHosts) > 0 {
+		sshConfigPath, err := updateEnrollSSHConfig(config, options, pubKeyDir)
 		if err != nil {
-			fmt.Println(fmt.Sprintf("Couldn't write public key file: %s", authorizedKey))
-		} else {
-			fmt.Println(fmt.Sprintf("You can now run \"ssh-copy-id -f -i %s user@host\" to copy your credential to a remote server", outFile))
+			return result, enrollError(exitEnrollSSHConfig, fmt.Errorf("Couldn't update ssh config: %s", err))
+		}
+		result.Files = append(result.Files, sshConfigPath)
+	}
+
+	err = WriteConfigFile(options.ConfigPath, config)
+	if err != nil {
+		return result, enrollError(exitEnrollConfig, err)
+	}
+	result.Files = append(result.Files, options.ConfigPath)
+	committed = true
+
+	result.Status = "enrolled"
+	return result, nil
+}
+
+// updateEnrollSSHConfig - Point the hosts of the managed ssh config block at
+// every identity of the profile which has a public key file
+func updateEnrollSSHConfig(config *ConfigFile, options EnrollOptions, pubKeyDir string) (string, error) {
+	sshConfigPath := options.SSHConfigPath
+	if sshConfigPath == "" {
+		var err error
+		sshConfigPath, err = DefaultSSHConfig()
+		if err != nil {
+			return "", err
+		}
+	}
+	// Recorded in the config for unenroll
+	sshConfigPath, err := filepath.Abs(sshConfigPath)
+	if err != nil {
+		return "", err
+	}
+
+	selected, err := config.Select(options.Profile)
+	if err != nil {
+		return "", err
+	}
+
+	var identityFiles []string
+	for pubkey, identity := range selected.Identities {
+		pubFile := identity.PubKeyFile
+		// Identities enrolled before the file was recorded
+		if pubFile == "" && pubKeyDir != "" {
+			addr, err := UserPubKeyHexToAddress([]byte(pubkey))
+			if err != nil {
+				return "", err
+			}
+			pubFile = PubKeyFile(pubKeyDir, addr)
+		}
+		if _, err := os.Stat(pubFile); pubFile != "" && err == nil {
+			identityFiles = append(identityFiles, pubFile)
+			identity.SSHConfig = sshConfigPath
 		}
+	}
+	sort.Strings(identityFiles)
+
+	block := renderManagedBlock(options.Profile, options.SSHConfigHosts, config.SocketPath(options.Profile), identityFiles)
+	return sshConfigPath, UpdateSSHConfig(sshConfigPath, options.Profile, block)
+}
 
-		config[k] = v
+// EnrollMain - Run enroll and print the result, returns the exit code
+func EnrollMain(options EnrollOptions, jsonOutput bool) int {
+	// Keep stdout for the result
+	out := io.Writer(os.Stdout)
+	if jsonOutput {
+		out = os.Stderr
 	}
 
-	err = WriteConfigRaw(configPath, config)
+	result, err := Enroll(options, out)
+
+	code := 0
 	if err != nil {
-		panic(err)
+		code = exitEnrollFailed
+		if enrollErr, ok := err.(*EnrollError); ok {
+			code = enrollErr.Code
+			result.ErrorClass = enrollErr.Class()
+		}
+		result.Error = err.Error()
+	}
+
+	if jsonOutput {
+		if err := json.NewEncoder(os.Stdout).Encode(result); err != nil {
+			return exitEnrollFailed
+		}
+		return code
 	}
 
+	for _, identity := range result.Identities {
+		if identity.PubKeyFile != "" {
+			fmt.Println(fmt.Sprintf("Public key written to %s", identity.PubKeyFile))
+		} else {
+			fmt.Println(fmt.Sprintf("Public key: %s", identity.AuthorizedKey))
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return code
+	}
 	fmt.Println("Credential enrolled")
+	fmt.Println("You can now run \"tk-ssh-agent install-key user@host\" to copy your credential to a remote server")
+	return code
 }
@@ -0,0 +1,150 @@
+/*
+Copyright 2017, Trusted Key
+This file is part of Trusted Key SSH-Agent.
+
+Trusted Key SSH-Agent is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Trusted Key SSH-Agent is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Trusted Key SSH-Agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newFakeRP - A relying party that is also the wallet, the login is
+// approved right away and issues credentials for testPubKey
+func newFakeRP(t *testing.T) *httptest.Server {
+	var server *httptest.Server
+	reply := func(w http.ResponseWriter, value interface{}) {
+		if err := json.NewEncoder(w).Encode(value); err != nil {
+			t.Error(err)
+		}
+	}
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login/trustedkey/":
+			http.Redirect(w, r, server.URL+"/oauth/IDentify/login?query=1&nonce=nonce", http.StatusFound)
+		case "/oauth/IDentify/submitLogin":
+			reply(w, map[string]interface{}{"data": map[string]string{"nonce": "nonce", "checksum": "1234"}})
+		case "/oauth/IDentify/waitLogin":
+			if r.URL.Query().Get("nonce") != "nonce" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			reply(w, map[string]interface{}{"data": map[string]string{"url": server.URL + "/callback"}})
+		case "/credential_add":
+			reply(w, map[string]interface{}{testPubKey: map[string]string{
+				"rpURL":        server.URL,
+				"clientId":     "client-1",
+				"clientSecret": "secret",
+			}})
+		default:
+			reply(w, map[string]interface{}{})
+		}
+	}))
+	return server
+}
+
+func TestEnrollRemovesSecretOnFailure(t *testing.T) {
+	secretService := newFakeSecretService(t)
+	defer secretService.Close()
+	rp := newFakeRP(t)
+	defer rp.Close()
+
+	dir, err := ioutil.TempDir("", "tk-ssh-enroll")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Writing the public key file fails, after the secret was stored
+	notADir := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(notADir, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	options := EnrollOptions{
+		Username:    "user@example.com",
+		RpURL:       rp.URL,
+		ConfigPath:  filepath.Join(dir, "tk-ssh.json"),
+		SecretStore: secretStoreSecretService,
+		PubKeyDir:   notADir,
+		WritePubKey: true,
+	}
+	_, err = Enroll(options, ioutil.Discard)
+	if enrollErr, ok := err.(*EnrollError); !ok || enrollErr.Code != exitEnrollPubKey {
+		t.Fatalf("expected writing the public key to fail, got %v", err)
+	}
+	secretService.mutex.Lock()
+	items := len(secretService.items)
+	secretService.mutex.Unlock()
+	if items != 0 {
+		t.Errorf("expected the stored secret to be removed, %d left", items)
+	}
+	if _, err := os.Stat(options.ConfigPath); !os.IsNotExist(err) {
+		t.Errorf("expected no config to be written, got %v", err)
+	}
+
+	options.PubKeyDir = filepath.Join(dir, "keys")
+	if _, err := Enroll(options, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if secret, err := secretServiceLookup("client-1"); err != nil || secret != "secret" {
+		t.Errorf("expected the secret to be kept after enrolling, got %q, %v", secret, err)
+	}
+}
+
+func TestEnrollQRCode(t *testing.T) {
+	rp := newFakeRP(t)
+	defer rp.Close()
+
+	dir, err := ioutil.TempDir("", "tk-ssh-enroll")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	options := EnrollOptions{
+		RpURL:       rp.URL,
+		ConfigPath:  filepath.Join(dir, "tk-ssh.json"),
+		SecretStore: secretStorePlaintext,
+		PubKeyDir:   dir,
+		WritePubKey: true,
+		QRCode:      true,
+	}
+	var out bytes.Buffer
+	result, err := Enroll(options, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Identities) != 1 {
+		t.Errorf("expected one identity, got %+v", result.Identities)
+	}
+	// Shown as a QR code instead of sent to an email address
+	if !strings.Contains(out.String(), "Scan with the Trusted Key App") || strings.Contains(out.String(), "Code:") {
+		t.Errorf("expected only a QR code, got:\n%s", out.String())
+	}
+
+	options.Username = "user@example.com"
+	if _, err := Enroll(options, ioutil.Discard); err == nil {
+		t.Error("expected --email and --qr together to be refused")
+	}
+}
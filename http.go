@@ -19,16 +19,71 @@ along with Trusted Key SSH-Agent.  If not, see <http://www.gnu.org/licenses/>.
 package main
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"time"
 )
 
+// HTTPStatusError - Returned from HTTPGet when the RP answers with a non-200 status
+type HTTPStatusError struct {
+	StatusCode int
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("RP returned status code %d", e.StatusCode)
+}
+
+// isRetryable - Transient failures worth repeating the same request for
+func isRetryable(err error) bool {
+	switch e := err.(type) {
+	case *HTTPStatusError:
+		switch e.StatusCode {
+		case http.StatusRequestTimeout,
+			http.StatusTooManyRequests,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	case *url.Error:
+		return e.Timeout() || isRetryable(e.Err)
+	case *net.OpError:
+		// Connection refused or reset, not e.g. a bad certificate
+		return true
+	}
+	return err == context.DeadlineExceeded || err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// backoff - Exponential backoff with jitter for the given retry attempt
+func backoff(attempt int) time.Duration {
+	const (
+		base = 500 * time.Millisecond
+		max  = 10 * time.Second
+	)
+
+	d := max
+	if attempt < 5 {
+		d = base << uint(attempt)
+	}
+	if d > max {
+		d = max
+	}
+
+	// Anywhere between half and the full delay
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
 func encodeBase64Url(src []byte) []byte {
 	dst := make([]byte, base64.RawURLEncoding.EncodedLen(len(src)))
 	base64.RawURLEncoding.Encode(dst, src)
@@ -74,14 +129,15 @@ func getHmacJWS(url string, identity TKIdentity) ([]byte, error) {
 	return jws, nil
 }
 
-// HTTPGet - Send GET request to RP
-func HTTPGet(identity TKIdentity, requestPath string, params map[string]string) (map[string]interface{}, error) {
+// HTTPGet - Send GET request to RP, aborted when ctx is done
+func HTTPGet(ctx context.Context, identity TKIdentity, requestPath string, params map[string]string) (map[string]interface{}, error) {
 	client := &http.Client{}
 
 	req, err := http.NewRequest("GET", identity.rpURL+requestPath, nil)
 	if err != nil {
 		return nil, err
 	}
+	req = req.WithContext(ctx)
 
 	q := req.URL.Query()
 	for key, value := range params {
@@ -99,6 +155,7 @@ func HTTPGet(identity TKIdentity, requestPath string, params map[string]string)
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
@@ -106,8 +163,7 @@ func HTTPGet(identity TKIdentity, requestPath string, params map[string]string)
 	}
 
 	if resp.StatusCode != 200 {
-		err = fmt.Errorf("RP returned status code %d", resp.StatusCode)
-		return nil, err
+		return nil, &HTTPStatusError{StatusCode: resp.StatusCode}
 	}
 
 	var data map[string]interface{}
@@ -0,0 +1,341 @@
+/*
+Copyright 2017, Trusted Key
+This file is part of Trusted Key SSH-Agent.
+
+Trusted Key SSH-Agent is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Trusted Key SSH-Agent is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Trusted Key SSH-Agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"net"
+	"os"
+	"os/user"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Appends the authorized_keys line read from stdin unless a line with the
+// key (the script's first argument) is present. Run with sh -c so it works
+// whatever the login shell is.
+const installKeyScript = `umask 077
+mkdir -p .ssh && touch .ssh/authorized_keys || exit 1
+IFS= read -r line || exit 1
+if grep -qF "$1" .ssh/authorized_keys; then
+	echo present
+	exit 0
+fi
+if [ -s .ssh/authorized_keys ] && [ -n "$(tail -c 1 .ssh/authorized_keys)" ]; then
+	echo >> .ssh/authorized_keys
+fi
+printf '%s\n' "$line" >> .ssh/authorized_keys && echo added`
+
+// InstallKeyOptions - What to install where
+type InstallKeyOptions struct {
+	AuthorizedKeys []string // authorized_keys lines without options
+	From           string   // from="..." option, if not empty
+	Command        string   // command="..." option, if not empty
+	SockPath       string   // Agent to authenticate with
+}
+
+// authorizedKeyOptions - The options prefix for an authorized_keys line
+func authorizedKeyOptions(from string, command string) string {
+	quote := func(value string) string {
+		return `"` + strings.Replace(value, `"`, `\"`, -1) + `"`
+	}
+
+	var options []string
+	if from != "" {
+		options = append(options, "from="+quote(from))
+	}
+	if command != "" {
+		options = append(options, "command="+quote(command))
+	}
+	return strings.Join(options, ",")
+}
+
+// parseDestination - Split [user@]host[:port] into user and address
+func parseDestination(destination string) (string, string, error) {
+	username := ""
+	host := destination
+	if i := strings.LastIndex(destination, "@"); i >= 0 {
+		username = destination[:i]
+		host = destination[i+1:]
+	}
+	if username == "" {
+		usr, err := user.Current()
+		if err != nil {
+			return "", "", err
+		}
+		username = usr.Username
+	}
+
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(strings.Trim(host, "[]"), "22")
+	}
+	return username, host, nil
+}
+
+// How long connecting to a host may take
+const installKeyTimeout = 10 * time.Second
+
+// knownHosts - Host keys from the known_hosts files, checked like ssh does
+type knownHosts struct {
+	callback ssh.HostKeyCallback
+}
+
+func loadKnownHosts() (*knownHosts, error) {
+	var files []string
+	for _, file := range knownHostsFiles() {
+		if _, err := os.Stat(file); err == nil {
+			files = append(files, file)
+		}
+	}
+	if len(files) == 0 {
+		return nil, errors.New("No known_hosts file, connect with ssh once to verify the host key")
+	}
+
+	callback, err := knownhosts.New(files...)
+	if err != nil {
+		return nil, err
+	}
+	return &knownHosts{callback: callback}, nil
+}
+
+// HostKeyCallback - Verify the host key, with errors telling what to do
+func (k *knownHosts) HostKeyCallback() ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := k.callback(hostname, remote, key)
+		if keyErr, ok := err.(*knownhosts.KeyError); ok {
+			if len(keyErr.Want) == 0 {
+				return fmt.Errorf("Unknown host key %s, connect with ssh once to verify it", ssh.FingerprintSHA256(key))
+			}
+			want := keyErr.Want[0]
+			return fmt.Errorf("Host key %s doesn't match the one in %s:%d, the host key changed or someone is intercepting the connection",
+				ssh.FingerprintSHA256(key), want.Filename, want.Line)
+		}
+		return err
+	}
+}
+
+// probeKey - A key no host has, looking it up reports the known keys
+type probeKey struct{}
+
+func (probeKey) Type() string                        { return "tk-ssh-agent-probe" }
+func (probeKey) Marshal() []byte                     { return []byte("tk-ssh-agent-probe") }
+func (probeKey) Verify([]byte, *ssh.Signature) error { return errors.New("probe key can't verify") }
+
+// HostKeyAlgorithms - Algorithms of the keys known for address, so the host
+// offers one we can check. Empty (the default order) if there are none.
+func (k *knownHosts) HostKeyAlgorithms(address string) []string {
+	remote, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		remote = &net.TCPAddr{}
+	}
+
+	keyErr, ok := k.callback(address, remote, probeKey{}).(*knownhosts.KeyError)
+	if !ok {
+		return nil
+	}
+
+	var algorithms []string
+	seen := make(map[string]bool)
+	for _, known := range keyErr.Want {
+		keyAlgorithms := []string{known.Key.Type()}
+		if known.Key.Type() == ssh.KeyAlgoRSA {
+			keyAlgorithms = []string{"rsa-sha2-512", "rsa-sha2-256", ssh.KeyAlgoRSA}
+		}
+		for _, algorithm := range keyAlgorithms {
+			if !seen[algorithm] {
+				seen[algorithm] = true
+				algorithms = append(algorithms, algorithm)
+			}
+		}
+	}
+	return algorithms
+}
+
+// passwordAuth - Password and keyboard-interactive authentication asking on
+// the terminal, for hosts that don't have a key installed yet
+func passwordAuth(destination string) []ssh.AuthMethod {
+	password := ssh.PasswordCallback(func() (string, error) {
+		secret, err := readPassphrase(fmt.Sprintf("%s's password: ", destination), "")
+		return string(secret), err
+	})
+
+	interactive := ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+		for i, question := range questions {
+			secret, err := readPassphrase(fmt.Sprintf("(%s) %s", destination, question), "")
+			if err != nil {
+				return nil, err
+			}
+			answers[i] = string(secret)
+		}
+		return answers, nil
+	})
+
+	return []ssh.AuthMethod{password, interactive}
+}
+
+// installKey - Install authorized keys on a single host with the options
+// prefix, returns what was done per key
+func installKey(destination string, authorizedKeys []string, prefix string, agentClient agent.Agent, hostKeys *knownHosts) ([]string, error) {
+	username, address, err := parseDestination(destination)
+	if err != nil {
+		return nil, err
+	}
+
+	auth := []ssh.AuthMethod{}
+	if agentClient != nil {
+		auth = append(auth, ssh.PublicKeysCallback(agentClient.Signers))
+	}
+	auth = append(auth, passwordAuth(destination)...)
+
+	client, err := ssh.Dial("tcp", address, &ssh.ClientConfig{
+		User:              username,
+		Auth:              auth,
+		HostKeyCallback:   hostKeys.HostKeyCallback(),
+		HostKeyAlgorithms: hostKeys.HostKeyAlgorithms(address),
+		Timeout:           installKeyTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	var results []string
+	for _, authorizedKey := range authorizedKeys {
+		blob := strings.Fields(authorizedKey)[1]
+		line := authorizedKey
+		if prefix != "" {
+			line = prefix + " " + authorizedKey
+		}
+
+		session, err := client.NewSession()
+		if err != nil {
+			return results, err
+		}
+		var stdout, stderr bytes.Buffer
+		session.Stdin = strings.NewReader(line + "\n")
+		session.Stdout = &stdout
+		session.Stderr = &stderr
+
+		script := strings.Replace(installKeyScript, "'", `'\''`, -1)
+		err = session.Run(fmt.Sprintf("sh -c '%s' sh %s", script, blob))
+		session.Close()
+		if err != nil {
+			if msg := strings.TrimSpace(stderr.String()); msg != "" {
+				return results, fmt.Errorf("%s: %s", err, msg)
+			}
+			return results, err
+		}
+		results = append(results, strings.TrimSpace(stdout.String()))
+	}
+	return results, nil
+}
+
+// InstallKeyMain - Install keys on every destination, reporting per host.
+// Returns an error if any host failed.
+func InstallKeyMain(destinations []string, options InstallKeyOptions) error {
+	if len(options.AuthorizedKeys) == 0 {
+		return errors.New("No identities to install, enroll one first")
+	}
+
+	prefix := authorizedKeyOptions(options.From, options.Command)
+
+	hostKeys, err := loadKnownHosts()
+	if err != nil {
+		return err
+	}
+
+	// Authenticate with the agent's keys (including proxied ones) if it's running
+	var agentClient agent.Agent
+	if conn, err := net.Dial("unix", options.SockPath); err == nil {
+		defer conn.Close()
+		agentClient = agent.NewClient(conn)
+	} else {
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("Could not connect to agent at %s, using password authentication: %s", options.SockPath, err))
+	}
+
+	failed := 0
+	for _, destination := range destinations {
+		results, err := installKey(destination, options.AuthorizedKeys, prefix, agentClient, hostKeys)
+		if err != nil {
+			failed++
+			fmt.Println(fmt.Sprintf("%s: failed: %s", destination, err))
+			continue
+		}
+		for i, result := range results {
+			addr := strings.Fields(options.AuthorizedKeys[i])[2]
+			switch result {
+			case "added":
+				fmt.Println(fmt.Sprintf("%s: installed %s", destination, addr))
+			case "present":
+				fmt.Println(fmt.Sprintf("%s: %s already installed", destination, addr))
+			default:
+				fmt.Println(fmt.Sprintf("%s: %s: unexpected output %q", destination, addr, result))
+			}
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("Failed to install on %d of %d hosts", failed, len(destinations))
+	}
+	return nil
+}
+
+// AuthorizedKeysFor - authorized_keys lines of the identities of profile,
+// or only the one ref refers to if not empty
+func AuthorizedKeysFor(configPath string, profile string, ref string) ([]string, error) {
+	config, err := ReadConfigFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	selected, err := config.Select(profile)
+	if err != nil {
+		return nil, err
+	}
+
+	var pubkeys []string
+	if ref != "" {
+		pubkey, err := findIdentity(selected, ref)
+		if err != nil {
+			return nil, err
+		}
+		pubkeys = append(pubkeys, pubkey)
+	} else {
+		for pubkey := range selected.Identities {
+			pubkeys = append(pubkeys, pubkey)
+		}
+		sort.Strings(pubkeys)
+	}
+
+	var authorizedKeys []string
+	for _, pubkey := range pubkeys {
+		authorizedKey, err := UserPubKeyHexToAuthorizedKey([]byte(pubkey))
+		if err != nil {
+			return nil, err
+		}
+		authorizedKeys = append(authorizedKeys, authorizedKey)
+	}
+	return authorizedKeys, nil
+}
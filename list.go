@@ -0,0 +1,193 @@
+/*
+Copyright 2017, Trusted Key
+This file is part of Trusted Key SSH-Agent.
+
+Trusted Key SSH-Agent is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Trusted Key SSH-Agent is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Trusted Key SSH-Agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Identity states reported by the list command
+const (
+	statusActive    = "active"
+	statusDisabled  = "disabled"   // Removed with ssh-add -d/-D
+	statusNotLoaded = "not loaded" // Not reloaded yet, or not in the agent's profile
+	statusUnknown   = "unknown"    // No agent running
+)
+
+// IdentityInfo - An enrolled identity as shown by the list command
+type IdentityInfo struct {
+	Address       string     `json:"address"`
+	PublicKey     string     `json:"publicKey"`
+	RpURL         string     `json:"rpURL"`
+	ClientID      string     `json:"clientId"`
+	SHA256        string     `json:"sha256"`
+	MD5           string     `json:"md5"`
+	AuthorizedKey string     `json:"authorizedKey"`
+	Enrolled      *time.Time `json:"enrolled,omitempty"`
+	Profiles      []string   `json:"profiles,omitempty"`
+	Status        string     `json:"status"`
+}
+
+// agentStatuses - Disabled state of every identity in the running agent by
+// public key blob, falling back to listing keys for agents without the
+// status extension
+func agentStatuses(sockPath string) (map[string]bool, error) {
+	statuses, err := AgentStatus(sockPath)
+	if err == agent.ErrExtensionUnsupported {
+		conn, err := net.Dial("unix", sockPath)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+
+		keys, err := agent.NewClient(conn).List()
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			statuses = append(statuses, IdentityStatus{Blob: key.Blob})
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	disabled := make(map[string]bool)
+	for _, status := range statuses {
+		disabled[string(status.Blob)] = status.Disabled
+	}
+	return disabled, nil
+}
+
+// ListIdentities - Describe the identities of profile (all if empty), with
+// their state in the agent listening on sockPath
+func ListIdentities(configPath string, profile string, sockPath string) ([]IdentityInfo, error) {
+	config, err := ReadConfigFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	selected, err := config.Select(profile)
+	if err != nil {
+		return nil, err
+	}
+
+	disabled, agentErr := agentStatuses(sockPath)
+	if agentErr != nil {
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("Could not query agent at %s: %s", sockPath, agentErr))
+	}
+
+	var infos []IdentityInfo
+	for pubkey, identity := range selected.Identities {
+		addr, err := UserPubKeyHexToAddress([]byte(pubkey))
+		if err != nil {
+			return nil, err
+		}
+		key, err := UserPubKeyHexToSSHPubKey([]byte(pubkey))
+		if err != nil {
+			return nil, err
+		}
+		authorizedKey, err := UserPubKeyHexToAuthorizedKey([]byte(pubkey))
+		if err != nil {
+			return nil, err
+		}
+
+		info := IdentityInfo{
+			Address:       addr,
+			PublicKey:     pubkey,
+			RpURL:         identity.RpURL,
+			ClientID:      identity.ClientID,
+			SHA256:        ssh.FingerprintSHA256(key),
+			MD5:           ssh.FingerprintLegacyMD5(key),
+			AuthorizedKey: authorizedKey,
+			Enrolled:      identity.Enrolled,
+			Status:        statusUnknown,
+		}
+		for _, name := range config.profileNames() {
+			if config.Profiles[name].Includes(pubkey, identity) {
+				info.Profiles = append(info.Profiles, name)
+			}
+		}
+		if agentErr == nil {
+			isDisabled, ok := disabled[string(key.Marshal())]
+			switch {
+			case !ok:
+				info.Status = statusNotLoaded
+			case isDisabled:
+				info.Status = statusDisabled
+			default:
+				info.Status = statusActive
+			}
+		}
+		infos = append(infos, info)
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Address < infos[j].Address
+	})
+	return infos, nil
+}
+
+// ListMain - Print the enrolled identities
+func ListMain(configPath string, profile string, sockPath string, jsonOutput bool) error {
+	infos, err := ListIdentities(configPath, profile, sockPath)
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput {
+		// An empty list rather than null
+		if infos == nil {
+			infos = []IdentityInfo{}
+		}
+		return json.NewEncoder(os.Stdout).Encode(infos)
+	}
+
+	if len(infos) == 0 {
+		fmt.Println("No identities enrolled")
+		return nil
+	}
+
+	for i, info := range infos {
+		if i > 0 {
+			fmt.Println()
+		}
+		enrolled := "unknown"
+		if info.Enrolled != nil {
+			enrolled = info.Enrolled.Local().Format(time.RFC1123)
+		}
+		fmt.Println(fmt.Sprintf("%s (%s)", info.Address, info.Status))
+		fmt.Println(fmt.Sprintf("  RP URL:     %s", info.RpURL))
+		fmt.Println(fmt.Sprintf("  Client ID:  %s", info.ClientID))
+		fmt.Println(fmt.Sprintf("  Enrolled:   %s", enrolled))
+		fmt.Println(fmt.Sprintf("  SHA256:     %s", info.SHA256))
+		fmt.Println(fmt.Sprintf("  MD5:        MD5:%s", info.MD5))
+		if len(info.Profiles) > 0 {
+			fmt.Println(fmt.Sprintf("  Profiles:   %s", strings.Join(info.Profiles, ", ")))
+		}
+		fmt.Println(fmt.Sprintf("  %s", info.AuthorizedKey))
+	}
+	return nil
+}
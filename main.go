@@ -24,40 +24,41 @@ import (
 	"os"
 	"os/user"
 	"path"
-	"path/filepath"
-	"runtime"
 	"strings"
 )
 
-// hasArg - Check if an argument was passed (useful for strings which are non-nilable)
-func hasArg(args []string, argument string) bool {
-	for _, v := range args {
-		if strings.Replace(v, "-", "", -1) == argument {
-			return true
+// parseInterspersed - Parse flags appearing anywhere in args, returning
+// the positional arguments. Everything after "--" is positional.
+func parseInterspersed(flags *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		flags.Parse(args)
+		consumed := len(args) - len(flags.Args())
+		if consumed > 0 && args[consumed-1] == "--" {
+			return append(positional, flags.Args()...)
 		}
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
 	}
-	return false
 }
 
-func defaultSockPath() string {
-	defaultPath := "/tmp/tk-ssh-auth.sock"
-	sockName := "tk-ssh-auth.sock"
-
-	switch runtime.GOOS {
-	case "darwin":
-		return filepath.Join(os.Getenv("TMPDIR"), sockName)
-
-	case "linux":
-		// Not everyone actually follows XDG spec
-		xdgDir := os.Getenv("XDG_RUNTIME_DIR")
-		if xdgDir == "" {
-			return defaultPath
-		}
-		return filepath.Join(xdgDir, sockName)
-
-	default:
-		return defaultPath
+// profileSocket - The socket flag if given, otherwise the profile's socket
+func profileSocket(flags *flag.FlagSet, sockPath string, configPath string, profile string) (string, error) {
+	if IsFlagSet(flags, "socket") || profile == "" {
+		return sockPath, nil
 	}
+	config, err := ReadConfigFile(configPath)
+	if err != nil {
+		return "", err
+	}
+	if _, err := config.GetProfile(profile); err != nil {
+		return "", err
+	}
+	return config.SocketPath(profile), nil
 }
 
 func main() {
@@ -71,21 +72,36 @@ func main() {
 	agentQuiet := agentCommand.Bool("quiet", false, "Dont output shell command for config")
 	agentSystemd := agentCommand.Bool("systemd", false, "Use systemd socket activation")
 	agentBackend := agentCommand.String("proxy", "", "Proxy unknown identities to agent unix domain socket")
-	agentSockPath := agentCommand.String("socket", defaultSockPath(), "Path to unix domain socket")
+	agentSockPath := agentCommand.String("socket", defaultSockPath(""), "Path to unix domain socket")
+	agentAllowOtherUsers := agentCommand.Bool("allowOtherUsers", false, "Accept connections from processes running as other users")
+	agentWatch := agentCommand.Bool("watch", false, "Reload configuration when the config file changes")
 	agentConfigPath := agentCommand.String("config",
 		path.Join(usr.HomeDir, ".config", "tk-ssh.json"),
 		"/path/to/conf.json")
+	agentProfile := agentCommand.String("profile", "", "Only serve the identities of this profile, with its settings")
 
 	enrollCommand := flag.NewFlagSet("enroll", flag.ExitOnError)
 	enrollConfigPath := enrollCommand.String("config",
 		path.Join(usr.HomeDir, ".config", "tk-ssh.json"),
 		"/path/to/conf.json")
 	enrollRpURLFlag := enrollCommand.String("rpURL",
-		"https://ssh.trustedkey.com",
+		defaultRpURL,
 		"Relying party URL")
 	enrollEmail := enrollCommand.String("email",
 		"",
-		"Email address (required)")
+		"Email address (required unless --qr)")
+	enrollSecretStore := enrollCommand.String("secretStore",
+		"",
+		"Where to keep the client secret (passphrase|secret-service|plaintext), defaults to secret-service if available and passphrase otherwise")
+	enrollProfile := enrollCommand.String("profile", "", "Add the identity to this profile, defaults rpURL to the profile's")
+	enrollJSON := enrollCommand.Bool("json", false, "Print the result as JSON, exit codes tell failures apart")
+	enrollNoWritePubKey := enrollCommand.Bool("noWritePubkey", false, "Don't write public key files")
+	enrollPubKeyDir := enrollCommand.String("pubkeyDir", "", "Directory for public key files (default ~/.ssh)")
+	enrollTimeout := enrollCommand.Duration("timeout", defaultEnrollTimeout, "How long to wait for approval in the app")
+	enrollQRCode := enrollCommand.Bool("qr", false, "Log in by scanning a QR code with the app instead of by --email")
+	enrollSSHConfig := enrollCommand.String("sshConfig", "", "Use the identities for these host patterns in ~/.ssh/config (e.g. \"*.example.com,bastion\")")
+	enrollSSHConfigPath := enrollCommand.String("sshConfigFile", "", "ssh client config to update (default ~/.ssh/config)")
+	enrollExport := enrollCommand.String("export", "", "Also write the public keys as rfc4716 and/or pkcs8 (comma separated)")
 
 	configCommand := flag.NewFlagSet("config", flag.ExitOnError)
 	configConfigPath := configCommand.String("config",
@@ -93,7 +109,65 @@ func main() {
 		"/path/to/conf.json")
 	configProxy := configCommand.String("proxy",
 		"",
-		"Set default proxy")
+		"Set default proxy, or with get and list show it overridden")
+	configJSON := configCommand.Bool("json", false, "Output JSON (get and list)")
+	configProfile := configCommand.String("profile", "", "Get and set the settings of this profile")
+	configAction := ""
+	var configArgs []string
+
+	cancelCommand := flag.NewFlagSet("cancel", flag.ExitOnError)
+	cancelSockPath := cancelCommand.String("socket", defaultSockPath(""), "Path to unix domain socket")
+	cancelConfigPath := cancelCommand.String("config",
+		path.Join(usr.HomeDir, ".config", "tk-ssh.json"),
+		"/path/to/conf.json")
+	cancelProfile := cancelCommand.String("profile", "", "Use the socket of this profile")
+
+	enableCommand := flag.NewFlagSet("enable", flag.ExitOnError)
+	enableSockPath := enableCommand.String("socket", defaultSockPath(""), "Path to unix domain socket")
+	enableConfigPath := enableCommand.String("config",
+		path.Join(usr.HomeDir, ".config", "tk-ssh.json"),
+		"/path/to/conf.json")
+	enableProfile := enableCommand.String("profile", "", "Use the socket of this profile")
+
+	notifyTestCommand := flag.NewFlagSet("notify-test", flag.ExitOnError)
+	notifyTestConfigPath := notifyTestCommand.String("config",
+		path.Join(usr.HomeDir, ".config", "tk-ssh.json"),
+		"/path/to/conf.json")
+	notifyTestProfile := notifyTestCommand.String("profile", "", "Use the notification settings of this profile")
+	notifyTestBackend := notifyTestCommand.String("backend", "", "Try these backends instead of the configured ones (comma separated)")
+
+	listCommand := flag.NewFlagSet("list", flag.ExitOnError)
+	listConfigPath := listCommand.String("config",
+		path.Join(usr.HomeDir, ".config", "tk-ssh.json"),
+		"/path/to/conf.json")
+	listProfile := listCommand.String("profile", "", "Only list the identities of this profile")
+	listSockPath := listCommand.String("socket", defaultSockPath(""), "Path to unix domain socket of the agent to query")
+	listJSON := listCommand.Bool("json", false, "Output JSON")
+
+	unenrollCommand := flag.NewFlagSet("unenroll", flag.ExitOnError)
+	unenrollConfigPath := unenrollCommand.String("config",
+		path.Join(usr.HomeDir, ".config", "tk-ssh.json"),
+		"/path/to/conf.json")
+	unenrollProfile := unenrollCommand.String("profile", "", "Notify the agent of this profile")
+	unenrollSockPath := unenrollCommand.String("socket", defaultSockPath(""), "Path to unix domain socket of the agent to notify")
+	unenrollRevoke := unenrollCommand.Bool("revoke", false, "Revoke the client credentials on the relying party first, keep the identity if that fails")
+	var unenrollArgs []string
+
+	// Authenticate with the agent ssh uses, usually the Trusted Key agent
+	installSockPath := os.Getenv("SSH_AUTH_SOCK")
+	if installSockPath == "" {
+		installSockPath = defaultSockPath("")
+	}
+	installCommand := flag.NewFlagSet("install-key", flag.ExitOnError)
+	installConfigPath := installCommand.String("config",
+		path.Join(usr.HomeDir, ".config", "tk-ssh.json"),
+		"/path/to/conf.json")
+	installProfile := installCommand.String("profile", "", "Install the identities of this profile")
+	installSocket := installCommand.String("socket", installSockPath, "Path to unix domain socket of the agent to authenticate with")
+	installIdentity := installCommand.String("identity", "", "Only install this identity (address, public key or fingerprint)")
+	installFrom := installCommand.String("from", "", "Restrict the key to these client addresses (from= option)")
+	installForceCommand := installCommand.String("command", "", "Force this command for the key (command= option)")
+	var installArgs []string
 
 	printDefaults := func() {
 		fmt.Println(fmt.Sprintf("Usage: \"%s agent\" or \"%s enroll\"", os.Args[0], os.Args[0]))
@@ -101,12 +175,30 @@ func main() {
 		fmt.Println("\nUsage of enroll:")
 		enrollCommand.PrintDefaults()
 
-		fmt.Println("\nUsage of agent:")
+		fmt.Println("\nUsage of agent (every flag can also be set as TK_SSH_<FLAG>, e.g. TK_SSH_SOCKET):")
 		agentCommand.PrintDefaults()
 
-		fmt.Println("\nUsage of config:")
+		fmt.Println("\nUsage of config (or \"config get|set|unset|list|validate|migrate [key] [value]\"):")
 		configCommand.PrintDefaults()
 
+		fmt.Println("\nUsage of unenroll (\"unenroll <address|public key|fingerprint> [--revoke]\"):")
+		unenrollCommand.PrintDefaults()
+
+		fmt.Println("\nUsage of install-key (\"install-key [user@]host[:port] ...\"):")
+		installCommand.PrintDefaults()
+
+		fmt.Println("\nUsage of list:")
+		listCommand.PrintDefaults()
+
+		fmt.Println("\nUsage of cancel:")
+		cancelCommand.PrintDefaults()
+
+		fmt.Println("\nUsage of enable:")
+		enableCommand.PrintDefaults()
+
+		fmt.Println("\nUsage of notify-test:")
+		notifyTestCommand.PrintDefaults()
+
 		flag.PrintDefaults()
 	}
 
@@ -117,38 +209,114 @@ func main() {
 	switch os.Args[1] {
 	case "enroll":
 		enrollCommand.Parse(os.Args[2:])
+		err = ApplyFlagEnv(enrollCommand, "config", "profile", "rpURL")
 	case "agent":
 		agentCommand.Parse(os.Args[2:])
+		err = ApplyFlagEnv(agentCommand)
 	case "config":
-		configCommand.Parse(os.Args[2:])
+		// Actions come before flags, e.g. "config set proxy /path --config path"
+		if len(os.Args) > 2 && !strings.HasPrefix(os.Args[2], "-") {
+			configAction = os.Args[2]
+			configArgs = parseInterspersed(configCommand, os.Args[3:])
+		} else {
+			configCommand.Parse(os.Args[2:])
+		}
+		err = ApplyFlagEnv(configCommand, "config", "profile")
+	case "unenroll":
+		unenrollArgs = parseInterspersed(unenrollCommand, os.Args[2:])
+		err = ApplyFlagEnv(unenrollCommand, "socket", "config", "profile")
+	case "install-key":
+		installArgs = parseInterspersed(installCommand, os.Args[2:])
+		err = ApplyFlagEnv(installCommand, "config", "profile")
+	case "list":
+		listCommand.Parse(os.Args[2:])
+		err = ApplyFlagEnv(listCommand, "socket", "config", "profile")
+	case "cancel":
+		cancelCommand.Parse(os.Args[2:])
+		err = ApplyFlagEnv(cancelCommand, "socket", "config", "profile")
+	case "enable":
+		enableCommand.Parse(os.Args[2:])
+		err = ApplyFlagEnv(enableCommand, "socket", "config", "profile")
+	case "notify-test":
+		notifyTestCommand.Parse(os.Args[2:])
+		err = ApplyFlagEnv(notifyTestCommand, "config", "profile")
 	default:
 		printDefaults()
 		os.Exit(1)
 	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
 	if agentCommand.Parsed() {
 
-		configExtra := ReadConfigExtra(*agentConfigPath)
-
-		proxyBackend := ""
-		if hasKey(configExtra, "proxy") {
-			proxyBackend = configExtra["proxy"].(string)
+		var settings *Settings
+		config, err := ReadConfigFile(*agentConfigPath)
+		if err == nil {
+			config, err = config.Select(*agentProfile)
+		}
+		if err == nil {
+			settings, err = config.EffectiveSettings()
+		}
+		sockPath := *agentSockPath
+		if err == nil {
+			sockPath, err = profileSocket(agentCommand, *agentSockPath, *agentConfigPath, *agentProfile)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
-		if *agentBackend != "" {
+
+		// Flag (or TK_SSH_PROXY) > config file
+		proxyBackend := settings.Proxy
+		if IsFlagSet(agentCommand, "proxy") {
 			proxyBackend = *agentBackend
 		}
 
-		AgentMain(*agentQuiet, *agentOutputShell, *agentConfigPath, *agentSockPath, proxyBackend, *agentSystemd)
+		AgentMain(*agentQuiet, *agentOutputShell, *agentConfigPath, *agentProfile, sockPath, proxyBackend, *agentSystemd, *agentAllowOtherUsers, *agentWatch)
 	} else if enrollCommand.Parsed() {
-		if *enrollEmail == "" {
+		if *enrollEmail == "" && !*enrollQRCode && !*enrollJSON {
 			enrollCommand.PrintDefaults()
-			os.Exit(1)
+			os.Exit(exitEnrollUsage)
+		}
+
+		options := EnrollOptions{
+			Username:    *enrollEmail,
+			ConfigPath:  *enrollConfigPath,
+			Profile:     *enrollProfile,
+			SecretStore: *enrollSecretStore,
+			PubKeyDir:   *enrollPubKeyDir,
+			WritePubKey: !*enrollNoWritePubKey,
+			Timeout:     *enrollTimeout,
+			QRCode:      *enrollQRCode,
+
+			ExportFormats:  splitList(*enrollExport),
+			SSHConfigHosts: splitList(*enrollSSHConfig),
+			SSHConfigPath:  *enrollSSHConfigPath,
+		}
+		// Otherwise the profile's or the default
+		if IsFlagSet(enrollCommand, "rpURL") {
+			options.RpURL = *enrollRpURLFlag
 		}
 
-		EnrollMain(*enrollEmail, *enrollRpURLFlag, *enrollConfigPath)
+		os.Exit(EnrollMain(options, *enrollJSON))
+	} else if configCommand.Parsed() && configAction != "" {
+
+		// Settings given as flags, like the agent's --proxy
+		var configFlags map[string]string
+		if IsFlagSet(configCommand, "proxy") {
+			configFlags = map[string]string{"proxy": *configProxy}
+		}
+
+		err := ConfigActionMain(*configConfigPath, *configProfile, configAction, configArgs, configFlags, *configJSON)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 	} else if configCommand.Parsed() {
 
-		if !hasArg(os.Args[2:], "proxy") {
+		if !IsFlagSet(configCommand, "proxy") {
 			configProxy = nil
 		}
 
@@ -157,5 +325,77 @@ func main() {
 			panic(err)
 		}
 		fmt.Println("Updated configuration!")
+	} else if unenrollCommand.Parsed() {
+		if len(unenrollArgs) != 1 {
+			unenrollCommand.PrintDefaults()
+			os.Exit(1)
+		}
+
+		sockPath, err := profileSocket(unenrollCommand, *unenrollSockPath, *unenrollConfigPath, *unenrollProfile)
+		if err == nil {
+			err = UnenrollMain(*unenrollConfigPath, unenrollArgs[0], sockPath, *unenrollRevoke)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	} else if installCommand.Parsed() {
+		if len(installArgs) == 0 {
+			installCommand.PrintDefaults()
+			os.Exit(1)
+		}
+
+		authorizedKeys, err := AuthorizedKeysFor(*installConfigPath, *installProfile, *installIdentity)
+		if err == nil {
+			err = InstallKeyMain(installArgs, InstallKeyOptions{
+				AuthorizedKeys: authorizedKeys,
+				From:           *installFrom,
+				Command:        *installForceCommand,
+				SockPath:       *installSocket,
+			})
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	} else if listCommand.Parsed() {
+
+		sockPath, err := profileSocket(listCommand, *listSockPath, *listConfigPath, *listProfile)
+		if err == nil {
+			err = ListMain(*listConfigPath, *listProfile, sockPath, *listJSON)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	} else if cancelCommand.Parsed() {
+
+		sockPath, err := profileSocket(cancelCommand, *cancelSockPath, *cancelConfigPath, *cancelProfile)
+		if err == nil {
+			err = CancelMain(sockPath)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("Cancelled pending requests")
+	} else if enableCommand.Parsed() {
+
+		sockPath, err := profileSocket(enableCommand, *enableSockPath, *enableConfigPath, *enableProfile)
+		if err == nil {
+			err = EnableMain(sockPath)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("Re-enabled identities")
+	} else if notifyTestCommand.Parsed() {
+
+		err := NotifyTestMain(*notifyTestConfigPath, *notifyTestProfile, splitList(*notifyTestBackend))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 	}
 }
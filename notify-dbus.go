@@ -0,0 +1,193 @@
+/*
+Copyright 2017, Trusted Key
+This file is part of Trusted Key SSH-Agent.
+
+Trusted Key SSH-Agent is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Trusted Key SSH-Agent is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Trusted Key SSH-Agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"html"
+	"sync"
+)
+
+const (
+	notificationsName      = "org.freedesktop.Notifications"
+	notificationsPath      = "/org/freedesktop/Notifications"
+	notificationsInterface = "org.freedesktop.Notifications"
+
+	notificationCancelAction = "cancel"
+
+	// How long the outcome of a request stays on screen, in milliseconds
+	notificationOutcomeTimeout = 5000
+)
+
+// dbusNotification - A notification shown by the desktop notification
+// daemon, kept open until the request it is about finishes
+type dbusNotification struct {
+	conn   *dbusConn
+	appID  string
+	markup bool
+
+	mutex  sync.Mutex
+	id     uint32
+	closed bool // Dismissed by the user or expired
+}
+
+// notifyDBus - Show msg and otp through org.freedesktop.Notifications,
+// cancel is run when the "Cancel" button is clicked
+func notifyDBus(appID string, msg string, otp string, cancel func()) (*dbusNotification, error) {
+	conn, err := dialSessionBus()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := conn.Call(notificationsName, notificationsPath, notificationsInterface, "GetCapabilities", "", nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	d, err := reply.decoder("as")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	capabilities := d.strings()
+
+	n := &dbusNotification{
+		conn:   conn,
+		appID:  appID,
+		markup: containsString(capabilities, "body-markup"),
+	}
+
+	var actions []string
+	if cancel != nil && containsString(capabilities, "actions") {
+		actions = []string{notificationCancelAction, "Cancel"}
+	}
+
+	conn.OnSignal(func(m *dbusMessage) {
+		if m.Interface != notificationsInterface {
+			return
+		}
+		d, err := m.decoder(m.Signature)
+		if err != nil {
+			return
+		}
+		id := d.uint32()
+
+		switch m.Member {
+		case "ActionInvoked":
+			if action := d.string(); d.err == nil && n.is(id) && action == notificationCancelAction {
+				cancel()
+			}
+		case "NotificationClosed":
+			if n.is(id) {
+				n.mutex.Lock()
+				n.closed = true
+				n.mutex.Unlock()
+				// Don't bother the user with the outcome either
+				go conn.Close()
+			}
+		}
+	})
+	err = conn.AddMatch("type='signal',interface='" + notificationsInterface + "',path='" + notificationsPath + "'")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// Stays until we close it
+	if err := n.show(msg, otp, actions, 0); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return n, nil
+}
+
+// is - Whether id is our notification
+func (n *dbusNotification) is(id uint32) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.id != 0 && n.id == id
+}
+
+// show - Show or replace the notification, expireTimeout 0 never expires
+func (n *dbusNotification) show(msg string, otp string, actions []string, expireTimeout int32) error {
+	text := msg
+	if otp != "" {
+		text = msg + " \nCode: " + otp
+	}
+	if n.markup {
+		text = html.EscapeString(text)
+	}
+
+	n.mutex.Lock()
+	replacesID := n.id
+	n.mutex.Unlock()
+
+	body := &dbusEncoder{}
+	body.string(n.appID)
+	body.uint32(replacesID)
+	body.string("")      // Icon
+	body.string(n.appID) // Summary
+	body.string(text)
+	body.strings(actions)
+	body.array(8, func() {
+		// Hints, urgency normal
+		body.align(8)
+		body.string("urgency")
+		body.variant("y", func() { body.byte(1) })
+	})
+	body.int32(expireTimeout)
+
+	reply, err := n.conn.Call(notificationsName, notificationsPath, notificationsInterface, "Notify", "susssasa{sv}i", body.buf)
+	if err != nil {
+		return err
+	}
+	d, err := reply.decoder("u")
+	if err != nil {
+		return err
+	}
+	id := d.uint32()
+	if d.err != nil {
+		return d.err
+	}
+
+	n.mutex.Lock()
+	n.id = id
+	n.mutex.Unlock()
+	return nil
+}
+
+// Done - Replace the notification with a short lived one when the login
+// was approved, close it otherwise
+func (n *dbusNotification) Done(approved bool) {
+	n.mutex.Lock()
+	closed := n.closed
+	id := n.id
+	n.mutex.Unlock()
+
+	if !closed {
+		if approved {
+			n.show("SSH login approved", "", nil, notificationOutcomeTimeout)
+		} else {
+			body := &dbusEncoder{}
+			body.uint32(id)
+			n.conn.Call(notificationsName, notificationsPath, notificationsInterface, "CloseNotification", "u", body.buf)
+		}
+	}
+	n.conn.Close()
+}
@@ -19,14 +19,50 @@ along with Trusted Key SSH-Agent.  If not, see <http://www.gnu.org/licenses/>.
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path"
 	"runtime"
 	"strings"
+	"sync"
+	"time"
 )
 
+// How long a single backend may take to show a notification
+const notifyTimeout = 10 * time.Second
+
+// Notification backends, tried in the order given by the "notify" setting
+const (
+	notifyDBusBackend      = "dbus"       // org.freedesktop.Notifications, with a Cancel button
+	notifyLibnotifyBackend = "libnotify"  // notify-send
+	notifyOsascriptBackend = "osascript"  // macOS notification center
+	notifyMsgBackend       = "msg"        // msg.exe on Windows and WSL
+	notifyTTYBackend       = "tty"        // Bell and message on the agent's terminal
+	notifyClientTTYBackend = "client-tty" // Message on the terminal of the ssh client
+	notifyCommandBackend   = "command"    // notifyCommand setting
+	notifyWebhookBackend   = "webhook"    // POST to the notifyWebhook setting
+	notifyNoneBackend      = "none"       // Don't notify at all
+)
+
+var notifyBackends = []string{
+	notifyDBusBackend,
+	notifyLibnotifyBackend,
+	notifyOsascriptBackend,
+	notifyMsgBackend,
+	notifyTTYBackend,
+	notifyClientTTYBackend,
+	notifyCommandBackend,
+	notifyWebhookBackend,
+	notifyNoneBackend,
+}
+
 // inPath - Check if command is present in $PATH
 func inPath(command string) bool {
 	paths := strings.Split(os.Getenv("PATH"), ":")
@@ -41,8 +77,88 @@ func inPath(command string) bool {
 	return false
 }
 
-func notifyWindows(appID string, msg string, otp string) error {
-	body := []byte(fmt.Sprintf("%s \r\nCode: %s", msg, otp))
+// defaultNotifyBackends - What to try when the "notify" setting is empty
+func defaultNotifyBackends() []string {
+	switch runtime.GOOS {
+	case "darwin":
+		return []string{notifyOsascriptBackend, notifyTTYBackend}
+
+	case "windows":
+		return []string{notifyMsgBackend, notifyTTYBackend}
+
+	case "linux":
+		// Windows Subsystem for Linux lies about being Linux
+		if inPath("msg.exe") {
+			return []string{notifyMsgBackend, notifyTTYBackend}
+		}
+	}
+
+	// Proper Linux, and a freedesktop.org notification daemon on unsupported platforms
+	return []string{notifyDBusBackend, notifyLibnotifyBackend, notifyTTYBackend}
+}
+
+// NotifyRequest - What to tell the user about a signature request
+type NotifyRequest struct {
+	Title   string   `json:"title"`
+	Message string   `json:"message"`
+	Details []string `json:"details,omitempty"` // Destination host, requesting process
+	OTP     string   `json:"code"`
+
+	// Aborts the request, for notifications with a button
+	Cancel func() `json:"-"`
+	// Process asking for the signature, 0 if unknown
+	PID int `json:"-"`
+}
+
+// NewNotifyRequest - A request to verify a login with otp
+func NewNotifyRequest(otp string, details ...string) *NotifyRequest {
+	return &NotifyRequest{
+		Title:   "Trusted Key SSH Agent",
+		Message: "Verify SSH Login request on your Trusted Key App",
+		Details: details,
+		OTP:     otp,
+	}
+}
+
+// Text - Message and details, one per line
+func (r *NotifyRequest) Text() string {
+	return strings.Join(append([]string{r.Message}, r.Details...), "\n")
+}
+
+// Notification - A notification about a pending signature request
+type Notification interface {
+	// Done - The request finished, approved or not
+	Done(approved bool)
+}
+
+// staticNotification - Notifications which can't be updated once shown
+type staticNotification struct{}
+
+func (staticNotification) Done(approved bool) {}
+
+// Notifier - A way of telling the user about signature requests
+type Notifier interface {
+	Notify(request *NotifyRequest) (Notification, error)
+}
+
+// notifyFunc - Adapts fire and forget backends to Notifier
+type notifyFunc func(request *NotifyRequest) error
+
+func (f notifyFunc) Notify(request *NotifyRequest) (Notification, error) {
+	if err := f(request); err != nil {
+		return nil, err
+	}
+	return staticNotification{}, nil
+}
+
+type dbusNotifier struct{}
+
+func (dbusNotifier) Notify(request *NotifyRequest) (Notification, error) {
+	return notifyDBus(request.Title, request.Text(), request.OTP, request.Cancel)
+}
+
+func notifyWindows(request *NotifyRequest) error {
+	body := []byte(fmt.Sprintf("%s \r\nCode: %s", request.Text(), request.OTP))
 	cmd := exec.Command("msg.exe", "*")
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
@@ -55,54 +171,269 @@ func notifyWindows(appID string, msg string, otp string) error {
 	return cmd.Run()
 }
 
-func notifyLibnotify(appID string, msg string, otp string) error {
-	body := fmt.Sprintf("%s \nCode: %s", msg, otp)
-	return exec.Command("notify-send", appID, body).Run()
+func notifyLibnotify(request *NotifyRequest) error {
+	body := fmt.Sprintf("%s \nCode: %s", request.Text(), request.OTP)
+	return exec.Command("notify-send", request.Title, body).Run()
+}
+
+// appleScriptQuote - Escape s for use inside an AppleScript string literal
+func appleScriptQuote(s string) string {
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	return strings.Replace(s, "\"", "\\\"", -1)
 }
 
-func notifyDarwin(appID string, msg string, otp string) error {
-	osascript := fmt.Sprintf("display notification \"%s\" with title \"%s\" subtitle \"%s\"", otp, appID, msg)
+func notifyDarwin(request *NotifyRequest) error {
+	osascript := fmt.Sprintf("display notification \"%s\" with title \"%s\" subtitle \"%s\"",
+		appleScriptQuote(request.OTP), appleScriptQuote(request.Title), appleScriptQuote(request.Text()))
 	return exec.Command("osascript", "-e", osascript).Run()
 }
 
-// Notify - Send a desktop notification for OTP
-func Notify(otp string) {
-	appID := "Trusted Key SSH Agent"
-	msg := "Verify SSH Login request on your Trusted Key App"
+// notifyTTY - Ring the bell on the terminal the agent was started from
+func notifyTTY(request *NotifyRequest) error {
+	tty, err := os.OpenFile("/dev/tty", os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer tty.Close()
 
-	printNotification := func() {
-		fmt.Println(fmt.Sprintf("%s: %s", msg, otp))
+	_, err = fmt.Fprintf(tty, "\a%s\r\nCode: %s\r\n", strings.Replace(request.Text(), "\n", "\r\n", -1), request.OTP)
+	return err
+}
+
+// notifyClientTTY - Write to the controlling terminal of the requesting
+// process, for headless machines and mosh sessions
+func notifyClientTTY(request *NotifyRequest) error {
+	if request.PID == 0 {
+		return fmt.Errorf("Unknown client process")
 	}
+	text := fmt.Sprintf("\r\n%s: %s\r\nCode: %s\r\n", request.Title,
+		strings.Replace(request.Text(), "\n", "\r\n", -1), request.OTP)
+	return WriteControllingTTY(request.PID, text)
+}
 
-	var cmdError error
-	cmdError = nil
+// commandNotifier - Runs a shell command with the request in the environment
+type commandNotifier struct {
+	command string
+}
 
-	switch runtime.GOOS {
-	case "darwin":
-		cmdError = notifyDarwin(appID, msg, otp)
+func (n *commandNotifier) Notify(request *NotifyRequest) (Notification, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
 
-	case "windows":
-		cmdError = notifyWindows(appID, msg, otp)
+	cmd := exec.CommandContext(ctx, "sh", "-c", n.command)
+	cmd.Env = append(os.Environ(),
+		"TK_SSH_TITLE="+request.Title,
+		"TK_SSH_MESSAGE="+request.Text(),
+		"TK_SSH_OTP="+request.OTP)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return staticNotification{}, nil
+}
 
-	case "linux":
+// webhookNotifier - POSTs the request as JSON
+type webhookNotifier struct {
+	url string
+}
 
-		// Windows Subsystem for Linux lies about being Linux
-		if inPath("msg.exe") {
-			cmdError = notifyWindows(appID, msg, otp)
+func (n *webhookNotifier) Notify(request *NotifyRequest) (Notification, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{
+		Timeout: notifyTimeout,
+		// Not to a plain http URL either
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return fmt.Errorf("stopped after 10 redirects")
+			}
+			return validateWebhook(req.URL.String())
+		},
+	}
+	resp, err := client.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("webhook returned status code %d", resp.StatusCode)
+	}
+	return staticNotification{}, nil
+}
 
-		} else {
-			// Proper Linux
-			cmdError = notifyLibnotify(appID, msg, otp)
+// namedNotifier - A backend and its name, for error messages
+type namedNotifier struct {
+	name string
+	Notifier
+}
+
+// notifierChain - Tries backends in order until one works
+type notifierChain []namedNotifier
+
+// notify - Notify with the first working backend, returning its name
+func (c notifierChain) notify(request *NotifyRequest) (Notification, string, error) {
+	var failures []string
+	for _, backend := range c {
+		notification, err := backend.Notify(request)
+		if err == nil {
+			return notification, backend.name, nil
 		}
+		failures = append(failures, fmt.Sprintf("%s: %s", backend.name, err))
+	}
+	if len(failures) == 0 {
+		return nil, "", fmt.Errorf("No notification backends configured")
+	}
+	return nil, "", fmt.Errorf("No notification backend worked (%s)", strings.Join(failures, "; "))
+}
 
-	default:
-		// Assume libnotify on unsupported platforms
-		cmdError = notifyLibnotify(appID, msg, otp)
+func (c notifierChain) Notify(request *NotifyRequest) (Notification, error) {
+	notification, _, err := c.notify(request)
+	return notification, err
+}
+
+// validateNotify - Check the notification settings, backends needing
+// another setting must have it
+func validateNotify(settings *Settings) error {
+	for _, backend := range settings.Notify {
+		if !containsString(notifyBackends, backend) {
+			return fmt.Errorf("unknown backend %q, expected one of: %s", backend, strings.Join(notifyBackends, ", "))
+		}
+		if backend == notifyCommandBackend && settings.NotifyCommand == "" {
+			return fmt.Errorf("backend %q needs notifyCommand", backend)
+		}
+		if backend == notifyWebhookBackend {
+			if err := validateWebhook(settings.NotifyWebhook); err != nil {
+				return fmt.Errorf("backend %q needs %s", backend, err)
+			}
+		}
+	}
+	return nil
+}
+
+// validateWebhook - The request carries the login code, so it may only be
+// sent in the clear to this machine
+func validateWebhook(webhook string) error {
+	u, err := url.Parse(webhook)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("a notifyWebhook URL")
+	}
+	switch u.Scheme {
+	case "https":
+		return nil
+	case "http":
+		host := u.Hostname()
+		if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+			return nil
+		}
 	}
+	return fmt.Errorf("an https notifyWebhook, http is only allowed for localhost")
+}
 
-	if cmdError != nil {
-		printNotification()
+// Notifier - The notification backends to use, in order
+func (s *Settings) Notifier() Notifier {
+	backends := s.Notify
+	if len(backends) == 0 {
+		backends = defaultNotifyBackends()
+	}
+
+	var chain notifierChain
+	for _, backend := range backends {
+		var notifier Notifier
+		switch backend {
+		case notifyDBusBackend:
+			notifier = dbusNotifier{}
+		case notifyLibnotifyBackend:
+			notifier = notifyFunc(notifyLibnotify)
+		case notifyOsascriptBackend:
+			notifier = notifyFunc(notifyDarwin)
+		case notifyMsgBackend:
+			notifier = notifyFunc(notifyWindows)
+		case notifyTTYBackend:
+			notifier = notifyFunc(notifyTTY)
+		case notifyClientTTYBackend:
+			notifier = notifyFunc(notifyClientTTY)
+		case notifyCommandBackend:
+			notifier = &commandNotifier{command: s.NotifyCommand}
+		case notifyWebhookBackend:
+			notifier = &webhookNotifier{url: s.NotifyWebhook}
+		case notifyNoneBackend:
+			notifier = notifyFunc(func(request *NotifyRequest) error { return nil })
+		default:
+			// Rejected by validateNotify
+			continue
+		}
+		chain = append(chain, namedNotifier{name: backend, Notifier: notifier})
 	}
 
-	return
+	return chain
+}
+
+// Notify - Tell the user about a signature request, when no backend works
+// the code is printed on stderr (the journal when run by systemd)
+func Notify(notifier Notifier, request *NotifyRequest) Notification {
+	if notifier == nil {
+		notifier = (&Settings{}).Notifier()
+	}
+
+	notification, err := notifier.Notify(request)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("%s: %s", request.Text(), request.OTP))
+		return staticNotification{}
+	}
+	return notification
+}
+
+// NotifyTestMain - Send a sample request through the configured backends
+// (or the given ones) and report which one showed it
+func NotifyTestMain(configPath string, profile string, backends []string) error {
+	config, err := ReadConfigFile(configPath)
+	if err != nil {
+		return err
+	}
+	config, err = config.Select(profile)
+	if err != nil {
+		return err
+	}
+	settings, err := config.EffectiveSettings()
+	if err != nil {
+		return err
+	}
+	if len(backends) > 0 {
+		settings.Notify = backends
+	}
+	if err := validateNotify(settings); err != nil {
+		return fmt.Errorf("notify: %s", err)
+	}
+
+	var once sync.Once
+	cancelled := make(chan struct{})
+	request := NewNotifyRequest("000000", "This is a test, there is no login to verify")
+	request.PID = os.Getpid()
+	request.Cancel = func() {
+		once.Do(func() { close(cancelled) })
+	}
+
+	notification, backend, err := settings.Notifier().(notifierChain).notify(request)
+	if err != nil {
+		return err
+	}
+	fmt.Println(fmt.Sprintf("Notification sent with %s", backend))
+
+	// Give the user a chance to try the Cancel button
+	if _, ok := notification.(staticNotification); ok {
+		return nil
+	}
+	fmt.Println(fmt.Sprintf("Waiting %s for Cancel to be clicked", notifyTimeout))
+	select {
+	case <-cancelled:
+		fmt.Println("Cancel clicked")
+		notification.Done(false)
+	case <-time.After(notifyTimeout):
+		notification.Done(true)
+	}
+	return nil
 }
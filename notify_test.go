@@ -0,0 +1,45 @@
+/*
+Copyright 2017, Trusted Key
+This file is part of Trusted Key SSH-Agent.
+
+Trusted Key SSH-Agent is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Trusted Key SSH-Agent is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Trusted Key SSH-Agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"testing"
+)
+
+func TestValidateNotifyWebhook(t *testing.T) {
+	for webhook, valid := range map[string]bool{
+		"https://hooks.example.com/tk":  true,
+		"https://192.0.2.1:8443/":       true,
+		"http://localhost:8080/notify":  true,
+		"http://127.0.0.1/notify":       true,
+		"http://127.1.2.3/notify":       true,
+		"http://[::1]:8080/notify":      true,
+		"http://hooks.example.com/tk":   false,
+		"http://192.0.2.1/notify":       false,
+		"http://localhost.example.com/": false,
+		"ftp://localhost/notify":        false,
+		"hooks.example.com/tk":          false,
+		"":                              false,
+	} {
+		settings := &Settings{Notify: []string{notifyWebhookBackend}, NotifyWebhook: webhook}
+		if err := validateNotify(settings); (err == nil) != valid {
+			t.Errorf("%q: expected valid %v, got %v", webhook, valid, err)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+// +build freebsd
+
+/*
+Copyright 2017, Trusted Key
+This file is part of Trusted Key SSH-Agent.
+
+Trusted Key SSH-Agent is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Trusted Key SSH-Agent is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Trusted Key SSH-Agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"net"
+	"unsafe"
+)
+
+type xucred struct {
+	Version uint32
+	UID     uint32
+	Ngroups int16
+	Groups  [16]uint32
+	Pid     uintptr // Union with a pointer, cr_pid is set since FreeBSD 13
+}
+
+// GetPeerCred - Read credentials of the process on the other end of a unix
+// socket using LOCAL_PEERCRED, the command line is not available
+func GetPeerCred(conn net.Conn) (*PeerCred, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, errors.New("Not a unix domain socket")
+	}
+
+	rawConn, err := unixConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var cred xucred
+	var credErr error
+	err = rawConn.Control(func(fd uintptr) {
+		credErr = getsockopt(fd, localPeerCred, unsafe.Pointer(&cred), unsafe.Sizeof(cred))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if credErr != nil {
+		return nil, credErr
+	}
+	if cred.Version != xucredVersion {
+		return nil, errors.New("Unsupported xucred version")
+	}
+
+	peer := &PeerCred{
+		Pid: int(int32(cred.Pid)),
+		UID: int(cred.UID),
+	}
+	if cred.Ngroups > 0 {
+		peer.GID = int(cred.Groups[0])
+	}
+	return peer, nil
+}
@@ -0,0 +1,123 @@
+// +build linux
+
+/*
+Copyright 2017, Trusted Key
+This file is part of Trusted Key SSH-Agent.
+
+Trusted Key SSH-Agent is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Trusted Key SSH-Agent is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Trusted Key SSH-Agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Don't walk all the way up to init
+const maxPeerParents = 8
+
+// GetPeerCred - Read credentials of the process on the other end of a unix
+// socket using SO_PEERCRED and resolve it's command line from /proc
+func GetPeerCred(conn net.Conn) (*PeerCred, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, errors.New("Not a unix domain socket")
+	}
+
+	rawConn, err := unixConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var ucred *syscall.Ucred
+	var credErr error
+	err = rawConn.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if credErr != nil {
+		return nil, credErr
+	}
+
+	peer := &PeerCred{
+		Pid: int(ucred.Pid),
+		UID: int(ucred.Uid),
+		GID: int(ucred.Gid),
+	}
+
+	// The process may be gone already, credentials are still valid
+	peer.Exe, _ = os.Readlink(fmt.Sprintf("/proc/%d/exe", peer.Pid))
+	peer.Cmdline, _ = procCmdline(peer.Pid)
+
+	pid := peer.Pid
+	for i := 0; i < maxPeerParents; i++ {
+		pid, err = procParent(pid)
+		if err != nil || pid <= 1 {
+			break
+		}
+		cmdline, err := procCmdline(pid)
+		if err != nil {
+			break
+		}
+		peer.Parents = append(peer.Parents, cmdline)
+	}
+
+	return peer, nil
+}
+
+func procCmdline(pid int) (string, error) {
+	contents, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return "", err
+	}
+	args := bytes.Split(bytes.TrimRight(contents, "\x00"), []byte{0})
+	return string(bytes.Join(args, []byte(" "))), nil
+}
+
+// procStat - Fields of /proc/<pid>/stat following the command name,
+// starting with the state
+func procStat(pid int) ([]string, error) {
+	contents, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return nil, err
+	}
+
+	// The command name may contain spaces and parens, skip past the last paren
+	stat := string(contents)
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	if len(fields) < 5 {
+		return nil, errors.New("Malformed stat file")
+	}
+	return fields, nil
+}
+
+func procParent(pid int) (int, error) {
+	fields, err := procStat(pid)
+	if err != nil {
+		return 0, err
+	}
+
+	// State is followed by the parent pid
+	return strconv.Atoi(fields[1])
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2017, Trusted Key
+This file is part of Trusted Key SSH-Agent.
+
+Trusted Key SSH-Agent is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Trusted Key SSH-Agent is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Trusted Key SSH-Agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strconv"
+)
+
+// PolicyRule - Allow-list for a single identity, an empty list allows
+// anything for that category. All non-empty categories must match.
+type PolicyRule struct {
+	Executables []string `json:"executables"` // Executable paths or names, globs allowed
+	Hosts       []string `json:"hosts"`       // Destination hostnames (globs) or SHA256 host key fingerprints
+	Users       []string `json:"users"`       // Local user names or uids of the requesting process
+}
+
+// Policy - Which clients may request signatures from which identities,
+// rules are keyed by subject address or public key with "*" as fallback
+type Policy struct {
+	rules map[string]*PolicyRule
+}
+
+// PolicyError - Returned from Sign when a request was denied by policy
+type PolicyError struct {
+	addr   string
+	reason string
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("agent: request for %s denied by policy: %s", e.addr, e.reason)
+}
+
+// NewPolicy - Policy from the "policy" key of the config section
+func NewPolicy(rules map[string]*PolicyRule) *Policy {
+	if rules == nil {
+		rules = make(map[string]*PolicyRule)
+	}
+	return &Policy{rules: rules}
+}
+
+func (p *Policy) rule(identity TKIdentity) *PolicyRule {
+	if p == nil {
+		return nil
+	}
+	if rule := p.rules[identity.addr]; rule != nil {
+		return rule
+	}
+	if rule := p.rules[string(identity.pubkey)]; rule != nil {
+		return rule
+	}
+	return p.rules["*"]
+}
+
+// Check - Verify that conn may request a signature from identity
+func (p *Policy) Check(identity TKIdentity, conn *ConnInfo) error {
+	rule := p.rule(identity)
+	if rule == nil {
+		return nil
+	}
+
+	deny := func(format string, v ...interface{}) error {
+		return &PolicyError{addr: identity.addr, reason: fmt.Sprintf(format, v...)}
+	}
+
+	var peer *PeerCred
+	if conn != nil {
+		peer = conn.Peer
+	}
+
+	if len(rule.Executables) > 0 {
+		if peer == nil {
+			return deny("requesting process unknown")
+		}
+		// The command line is up to the client, only trust the kernel
+		if peer.Exe == "" {
+			return deny("executable of %s unknown", peer)
+		}
+		if !matchExecutable(rule.Executables, peer.Exe) {
+			return deny("executable %s not allowed", peer.Exe)
+		}
+	}
+
+	if len(rule.Users) > 0 {
+		if peer == nil {
+			return deny("requesting user unknown")
+		}
+		if !matchUser(rule.Users, peer.UID) {
+			return deny("uid %d not allowed", peer.UID)
+		}
+	}
+
+	if len(rule.Hosts) > 0 {
+		bind := conn.Bind()
+		if bind == nil {
+			return deny("destination host unknown (ssh client does not support session-bind)")
+		}
+		if !matchHost(rule.Hosts, bind) {
+			return deny("host %s not allowed", bind)
+		}
+	}
+
+	return nil
+}
+
+// DestinationConstrained - Whether identity may only be used for some hosts
+func (p *Policy) DestinationConstrained(identity TKIdentity) bool {
+	rule := p.rule(identity)
+	return rule != nil && len(rule.Hosts) > 0
+}
+
+func matchExecutable(patterns []string, exe string) bool {
+	for _, pattern := range patterns {
+		// Bare names match the executable name, anything else the full path
+		candidate := exe
+		if filepath.Base(pattern) == pattern {
+			candidate = filepath.Base(exe)
+		}
+		if ok, _ := filepath.Match(pattern, candidate); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func matchUser(users []string, uid int) bool {
+	name := ""
+	if usr, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+		name = usr.Username
+	}
+	for _, u := range users {
+		if u == strconv.Itoa(uid) || (name != "" && u == name) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchHost(patterns []string, bind *sessionBind) bool {
+	fingerprint := bind.Fingerprint()
+	for _, pattern := range patterns {
+		if pattern == fingerprint {
+			return true
+		}
+		for _, hostname := range bind.hostnames {
+			if ok, _ := path.Match(pattern, hostname); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+/*
+Copyright 2017, Trusted Key
+This file is part of Trusted Key SSH-Agent.
+
+Trusted Key SSH-Agent is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Trusted Key SSH-Agent is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Trusted Key SSH-Agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"testing"
+)
+
+func TestPolicyExecutableFailsClosed(t *testing.T) {
+	identity := TKIdentity{addr: "0x01", pubkey: []byte(testPubKey)}
+	policy := NewPolicy(map[string]*PolicyRule{
+		"*": {Executables: []string{"ssh", "/usr/bin/git"}},
+	})
+
+	for _, test := range []struct {
+		exe     string
+		cmdline string
+		allowed bool
+	}{
+		{"/usr/bin/ssh", "ssh example.com", true},
+		{"/usr/bin/git", "git fetch", true},
+		{"/usr/local/bin/git", "git fetch", false},
+		{"/usr/bin/python3", "ssh example.com", false},
+		// The executable couldn't be read, argv[0] is up to the client
+		{"", "ssh example.com", false},
+	} {
+		conn := &ConnInfo{Peer: &PeerCred{Pid: 42, Exe: test.exe, Cmdline: test.cmdline}}
+		err := policy.Check(identity, conn)
+		if allowed := err == nil; allowed != test.allowed {
+			t.Errorf("%q (%s): expected allowed %v, got %v", test.exe, test.cmdline, test.allowed, err)
+		}
+	}
+
+	if err := policy.Check(identity, &ConnInfo{}); err == nil {
+		t.Error("expected an unknown process to be denied")
+	}
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2017, Trusted Key
+This file is part of Trusted Key SSH-Agent.
+
+Trusted Key SSH-Agent is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Trusted Key SSH-Agent is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Trusted Key SSH-Agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// Every flag and config setting is resolved in the same order:
+//
+//   1. Command line flag, e.g. --socket
+//   2. Environment variable, e.g. TK_SSH_SOCKET
+//   3. The "config" section of the config file
+//   4. Built-in default
+//
+// Flags and settings sharing a name (proxy) share the environment variable.
+
+const envPrefix = "TK_SSH_"
+
+// EnvName - Environment variable for a flag or setting, e.g.
+// TK_SSH_SIGN_TIMEOUT for signTimeout
+func EnvName(key string) string {
+	var name []rune
+	runes := []rune(key)
+	for i, r := range runes {
+		if r == '-' {
+			r = '_'
+		} else if i > 0 && unicode.IsUpper(r) && unicode.IsLower(runes[i-1]) {
+			name = append(name, '_')
+		}
+		name = append(name, unicode.ToUpper(r))
+	}
+	return envPrefix + string(name)
+}
+
+// IsFlagSet - Check if a flag was passed on the command line (or set from
+// the environment by ApplyFlagEnv)
+func IsFlagSet(flags *flag.FlagSet, name string) bool {
+	found := false
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			found = true
+		}
+	})
+	return found
+}
+
+// ApplyFlagEnv - Set flags missing from the command line from the
+// environment, all flags unless names are given
+func ApplyFlagEnv(flags *flag.FlagSet, names ...string) error {
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		if err != nil || IsFlagSet(flags, f.Name) {
+			return
+		}
+		if len(names) > 0 && !containsString(names, f.Name) {
+			return
+		}
+		value, ok := os.LookupEnv(EnvName(f.Name))
+		if !ok {
+			return
+		}
+		if e := flags.Set(f.Name, value); e != nil {
+			err = fmt.Errorf("%s: %s", EnvName(f.Name), e)
+		}
+	})
+	return err
+}
+
+// ApplyEnv - Override settings with environment variables
+func (s *Settings) ApplyEnv() error {
+	for _, option := range settingOptions {
+		value, ok := os.LookupEnv(EnvName(option.Key))
+		if !ok {
+			continue
+		}
+		if err := option.apply(s, value); err != nil {
+			return fmt.Errorf("%s: %s", EnvName(option.Key), err)
+		}
+	}
+	return nil
+}
+
+// ApplyFlags - Override settings with command line flags, keyed by setting
+func (s *Settings) ApplyFlags(flags map[string]string) error {
+	for key, value := range flags {
+		option, err := findSettingOption(key)
+		if err != nil {
+			return err
+		}
+		if err := option.apply(s, value); err != nil {
+			return fmt.Errorf("--%s: %s", key, err)
+		}
+	}
+	return nil
+}
+
+// apply - Set an option from a flag or environment variable, an empty
+// value clears it
+func (o *settingOption) apply(s *Settings, value string) error {
+	if strings.TrimSpace(value) == "" {
+		o.unset(s)
+		return nil
+	}
+	return o.set(s, value)
+}
+
+// EffectiveSettings - The "config" section with environment variables
+// applied, the config file itself is left untouched
+func (c *ConfigFile) EffectiveSettings() (*Settings, error) {
+	settings := c.Config
+	if err := settings.ApplyEnv(); err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
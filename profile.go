@@ -0,0 +1,189 @@
+/*
+Copyright 2017, Trusted Key
+This file is part of Trusted Key SSH-Agent.
+
+Trusted Key SSH-Agent is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Trusted Key SSH-Agent is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Trusted Key SSH-Agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// Profile names end up in socket file names
+var profileNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// ValidateProfileName - Check that name can be used for a profile
+func ValidateProfileName(name string) error {
+	if !profileNamePattern.MatchString(name) {
+		return fmt.Errorf("Invalid profile name '%s', use only letters, digits, '-' and '_'", name)
+	}
+	return nil
+}
+
+// Profile - A named subset of identities with their own settings, e.g. to
+// run separate agents for a staging and a production relying party
+type Profile struct {
+	// Default relying party for enroll, identities enrolled with it are
+	// part of the profile
+	RpURL string `json:"rpURL,omitempty"`
+
+	// Additional identities, by public key or subject address
+	Identities []string `json:"identities,omitempty"`
+
+	// Agent socket, defaults to tk-ssh-auth-<profile>.sock
+	Socket string `json:"socket,omitempty"`
+
+	// Applied over the top-level "config" section
+	Config Settings `json:"config"`
+}
+
+// sameRpURL - Compare relying party URLs by scheme and host
+func sameRpURL(a string, b string) bool {
+	ua, err := url.ParseRequestURI(a)
+	if err != nil {
+		return false
+	}
+	ub, err := url.ParseRequestURI(b)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(ua.Scheme, ub.Scheme) && strings.EqualFold(ua.Host, ub.Host)
+}
+
+// matchIdentity - Check if entry (a public key or subject address) refers
+// to the identity with public key pubkey
+func matchIdentity(entry string, pubkey string) bool {
+	if strings.EqualFold(entry, pubkey) {
+		return true
+	}
+	addr, err := UserPubKeyHexToAddress([]byte(pubkey))
+	return err == nil && strings.EqualFold(entry, addr)
+}
+
+// Includes - Check if the identity with public key pubkey is part of the profile
+func (p *Profile) Includes(pubkey string, identity *IdentityConfig) bool {
+	if p.RpURL != "" && identity != nil && sameRpURL(p.RpURL, identity.RpURL) {
+		return true
+	}
+	for _, entry := range p.Identities {
+		if matchIdentity(entry, pubkey) {
+			return true
+		}
+	}
+	return false
+}
+
+// Add - Make the identity with public key pubkey part of the profile
+func (p *Profile) Add(pubkey string, identity *IdentityConfig) {
+	if !p.Includes(pubkey, identity) {
+		p.Identities = append(p.Identities, pubkey)
+	}
+}
+
+// profileNames - Sorted names of all profiles
+func (c *ConfigFile) profileNames() []string {
+	var names []string
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GetProfile - Look up a profile by name
+func (c *ConfigFile) GetProfile(name string) (*Profile, error) {
+	profile := c.Profiles[name]
+	if profile == nil {
+		if len(c.Profiles) == 0 {
+			return nil, fmt.Errorf("Unknown profile '%s', no profiles are configured", name)
+		}
+		return nil, fmt.Errorf("Unknown profile '%s', expected one of: %s", name, strings.Join(c.profileNames(), ", "))
+	}
+	return profile, nil
+}
+
+// Select - View of the configuration for a profile, with only the profile's
+// identities and its settings applied over the "config" section. The empty
+// name selects everything.
+func (c *ConfigFile) Select(name string) (*ConfigFile, error) {
+	if name == "" {
+		return c, nil
+	}
+	profile, err := c.GetProfile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	view := &ConfigFile{
+		Version:    c.Version,
+		Identities: make(map[string]*IdentityConfig),
+		Config:     c.Config.Merge(&profile.Config),
+	}
+	for key, identity := range c.Identities {
+		if profile.Includes(key, identity) {
+			view.Identities[key] = identity
+		}
+	}
+	return view, nil
+}
+
+// ProfileRpURL - The default relying party of a profile, or def
+func (c *ConfigFile) ProfileRpURL(name string, def string) string {
+	if profile := c.Profiles[name]; profile != nil && profile.RpURL != "" {
+		return profile.RpURL
+	}
+	return def
+}
+
+// SocketPath - Agent socket for a profile
+func (c *ConfigFile) SocketPath(name string) string {
+	if profile := c.Profiles[name]; profile != nil && profile.Socket != "" {
+		return profile.Socket
+	}
+	return defaultSockPath(name)
+}
+
+// defaultSockPath - Default agent socket, one per profile
+func defaultSockPath(profile string) string {
+	sockName := "tk-ssh-auth.sock"
+	if profile != "" {
+		sockName = fmt.Sprintf("tk-ssh-auth-%s.sock", profile)
+	}
+	defaultPath := filepath.Join("/tmp", sockName)
+
+	switch runtime.GOOS {
+	case "darwin":
+		return filepath.Join(os.Getenv("TMPDIR"), sockName)
+
+	case "linux":
+		// Not everyone actually follows XDG spec
+		xdgDir := os.Getenv("XDG_RUNTIME_DIR")
+		if xdgDir == "" {
+			return defaultPath
+		}
+		return filepath.Join(xdgDir, sockName)
+
+	default:
+		return defaultPath
+	}
+}
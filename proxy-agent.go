@@ -25,7 +25,7 @@ import (
 )
 
 type proxykeyring struct {
-	tkKeyRing    agent.Agent
+	tkKeyRing    *keyring
 	backendAgent agent.Agent
 }
 
@@ -42,8 +42,8 @@ func NewBackendAgent(backend string) (agent.Agent, error) {
 
 // NewProxyAgent - Use TK signing for known TK identities and forward unknown
 // ones to another agent
-func NewProxyAgent(identities []TKIdentity, backend agent.Agent) (agent.Agent, error) {
-	tkKeyRing := NewTKeyring(identities)
+func NewProxyAgent(config *AgentConfig, backend agent.Agent) (*proxykeyring, error) {
+	tkKeyRing := NewTKeyring(config)
 
 	return &proxykeyring{
 		tkKeyRing:    tkKeyRing,
@@ -51,6 +51,11 @@ func NewProxyAgent(identities []TKIdentity, backend agent.Agent) (agent.Agent, e
 	}, nil
 }
 
+// Reload - Swap in a new set of TK identities, the backend is kept as is
+func (r *proxykeyring) Reload(config *AgentConfig) error {
+	return r.tkKeyRing.Reload(config)
+}
+
 func (r *proxykeyring) List() ([]*agent.Key, error) {
 	tkList, err := r.tkKeyRing.List()
 	if err != nil {
@@ -74,7 +79,16 @@ func (r *proxykeyring) List() ([]*agent.Key, error) {
 }
 
 func (r *proxykeyring) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
-	signResult, err := r.tkKeyRing.Sign(key, data)
+	return r.SignWithFlags(key, data, 0)
+}
+
+func (r *proxykeyring) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	return r.SignConn(key, data, flags, nil)
+}
+
+// SignConn - Sign on behalf of a client connection, conn may be nil
+func (r *proxykeyring) SignConn(key ssh.PublicKey, data []byte, flags agent.SignatureFlags, conn *ConnInfo) (*ssh.Signature, error) {
+	signResult, err := r.tkKeyRing.SignConn(key, data, conn)
 	if signResult != nil {
 		return signResult, nil
 	}
@@ -82,22 +96,44 @@ func (r *proxykeyring) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, err
 		return nil, err
 	}
 
-	signResult, err = r.backendAgent.Sign(key, data)
+	if extendedAgent, ok := r.backendAgent.(agent.ExtendedAgent); ok {
+		signResult, err = extendedAgent.SignWithFlags(key, data, flags)
+	} else {
+		signResult, err = r.backendAgent.Sign(key, data)
+	}
 	if err != nil {
 		return nil, err
 	}
 	return signResult, nil
 }
 
+func (r *proxykeyring) Extension(extensionType string, contents []byte) ([]byte, error) {
+	extendedAgent, ok := r.backendAgent.(agent.ExtendedAgent)
+	if !ok {
+		return nil, agent.ErrExtensionUnsupported
+	}
+	return extendedAgent.Extension(extensionType, contents)
+}
+
 func (r *proxykeyring) Add(key agent.AddedKey) error {
 	return r.backendAgent.Add(key)
 }
 
 func (r *proxykeyring) Remove(key ssh.PublicKey) error {
+	err := r.tkKeyRing.Remove(key)
+	if err != ErrSignerNotFound {
+		return err
+	}
+
 	return r.backendAgent.Remove(key)
 }
 
 func (r *proxykeyring) RemoveAll() error {
+	err := r.tkKeyRing.RemoveAll()
+	if err != nil {
+		return err
+	}
+
 	return r.backendAgent.RemoveAll()
 }
 
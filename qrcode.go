@@ -0,0 +1,540 @@
+/*
+Copyright 2017, Trusted Key
+This file is part of Trusted Key SSH-Agent.
+
+Trusted Key SSH-Agent is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Trusted Key SSH-Agent is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Trusted Key SSH-Agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// QR codes (ISO/IEC 18004) in byte mode with error correction level M,
+// enough for the wallet login URL
+
+// qrECBlocks - Error correction codewords per block and number of blocks
+// for level M, indexed by version
+var qrECBlocks = [41][2]int{
+	{0, 0},
+	{10, 1}, {16, 1}, {26, 1}, {18, 2}, {24, 2}, {16, 4}, {18, 4}, {22, 4}, {22, 5}, {26, 5},
+	{30, 5}, {22, 8}, {22, 9}, {24, 9}, {24, 10}, {28, 10}, {28, 11}, {26, 13}, {26, 14}, {26, 16},
+	{26, 17}, {28, 17}, {28, 18}, {28, 20}, {28, 21}, {28, 23}, {28, 25}, {28, 26}, {28, 28}, {28, 29},
+	{28, 31}, {28, 33}, {28, 35}, {28, 37}, {28, 38}, {28, 40}, {28, 43}, {28, 45}, {28, 47}, {28, 49},
+}
+
+const (
+	qrMaxVersion = 40
+	qrLevelM     = 0 // Format information bits of level M
+)
+
+// qrCode - Modules of a QR code, true is dark
+type qrCode struct {
+	size     int
+	modules  [][]bool
+	function [][]bool // Finder, timing, alignment, format and version modules
+}
+
+// qrRawModules - Modules available for data and error correction
+func qrRawModules(version int) int {
+	n := (16*version+128)*version + 64
+	if version >= 2 {
+		align := version/7 + 2
+		n -= (25*align-10)*align - 55
+		if version >= 7 {
+			n -= 36
+		}
+	}
+	return n
+}
+
+// qrDataCodewords - Bytes of data a version holds at level M
+func qrDataCodewords(version int) int {
+	return qrRawModules(version)/8 - qrECBlocks[version][0]*qrECBlocks[version][1]
+}
+
+// qrAlignmentPositions - Centre coordinates of the alignment patterns
+func qrAlignmentPositions(version int) []int {
+	if version == 1 {
+		return nil
+	}
+	count := version/7 + 2
+	step := 26
+	if version != 32 {
+		step = (version*4 + count*2 + 1) / (count*2 - 2) * 2
+	}
+	positions := make([]int, count)
+	positions[0] = 6
+	for i, pos := count-1, version*4+10; i > 0; i, pos = i-1, pos-step {
+		positions[i] = pos
+	}
+	return positions
+}
+
+// qrMultiply - Multiplication in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1
+func qrMultiply(x, y byte) byte {
+	var z byte
+	for i := 7; i >= 0; i-- {
+		carry := z >> 7
+		z = z<<1 ^ carry*0x1d
+		z ^= (y >> uint(i) & 1) * x
+	}
+	return z
+}
+
+// qrReedSolomon - n error correction codewords for data
+func qrReedSolomon(data []byte, n int) []byte {
+	// Generator polynomial (x - 2^0)(x - 2^1)...(x - 2^(n-1)), highest
+	// coefficient left out
+	generator := make([]byte, n)
+	generator[n-1] = 1
+	root := byte(1)
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			generator[j] = qrMultiply(generator[j], root)
+			if j+1 < n {
+				generator[j] ^= generator[j+1]
+			}
+		}
+		root = qrMultiply(root, 2)
+	}
+
+	remainder := make([]byte, n)
+	for _, b := range data {
+		factor := b ^ remainder[0]
+		copy(remainder, remainder[1:])
+		remainder[n-1] = 0
+		for i := range remainder {
+			remainder[i] ^= qrMultiply(generator[i], factor)
+		}
+	}
+	return remainder
+}
+
+// qrCodewords - data in byte mode with padding and error correction,
+// interleaved in the order the codewords are placed
+func qrCodewords(data []byte, version int) []byte {
+	var bits []bool
+	appendBits := func(value int, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, value>>uint(i)&1 == 1)
+		}
+	}
+
+	capacity := qrDataCodewords(version) * 8
+	appendBits(0x4, 4) // Byte mode
+	if version <= 9 {
+		appendBits(len(data), 8)
+	} else {
+		appendBits(len(data), 16)
+	}
+	for _, b := range data {
+		appendBits(int(b), 8)
+	}
+	for i := 0; i < 4 && len(bits) < capacity; i++ {
+		bits = append(bits, false)
+	}
+	for len(bits)%8 != 0 {
+		bits = append(bits, false)
+	}
+	for pad := 0xec; len(bits) < capacity; pad ^= 0xec ^ 0x11 {
+		appendBits(pad, 8)
+	}
+
+	codewords := make([]byte, len(bits)/8)
+	for i, bit := range bits {
+		if bit {
+			codewords[i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+
+	// Blocks at the end hold one more data codeword when it doesn't divide evenly
+	ecLength, blockCount := qrECBlocks[version][0], qrECBlocks[version][1]
+	shortLength := len(codewords) / blockCount
+	longBlocks := len(codewords) % blockCount
+	var blocks, ecBlocks [][]byte
+	for i, start := 0, 0; i < blockCount; i++ {
+		length := shortLength
+		if i >= blockCount-longBlocks {
+			length++
+		}
+		block := codewords[start : start+length]
+		blocks = append(blocks, block)
+		ecBlocks = append(ecBlocks, qrReedSolomon(block, ecLength))
+		start += length
+	}
+
+	var result []byte
+	for i := 0; i <= shortLength; i++ {
+		for _, block := range blocks {
+			if i < len(block) {
+				result = append(result, block[i])
+			}
+		}
+	}
+	for i := 0; i < ecLength; i++ {
+		for _, block := range ecBlocks {
+			result = append(result, block[i])
+		}
+	}
+	return result
+}
+
+// newQRCode - Encode data as version with the given mask pattern (0-7)
+func newQRCode(data []byte, version int, mask int) *qrCode {
+	size := version*4 + 17
+	q := &qrCode{size: size}
+	for i := 0; i < size; i++ {
+		q.modules = append(q.modules, make([]bool, size))
+		q.function = append(q.function, make([]bool, size))
+	}
+
+	q.drawFunctionPatterns(version)
+	q.drawCodewords(qrCodewords(data, version))
+	q.applyMask(mask)
+	q.drawFormat(mask)
+	return q
+}
+
+// set - Draw a function module
+func (q *qrCode) set(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+func (q *qrCode) drawFunctionPatterns(version int) {
+	for i := 0; i < q.size; i++ {
+		q.set(6, i, i%2 == 0)
+		q.set(i, 6, i%2 == 0)
+	}
+
+	// Finder patterns with their separators
+	for _, corner := range [][2]int{{3, 3}, {q.size - 4, 3}, {3, q.size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := corner[0]+dx, corner[1]+dy
+				if x < 0 || x >= q.size || y < 0 || y >= q.size {
+					continue
+				}
+				distance := abs(dx)
+				if abs(dy) > distance {
+					distance = abs(dy)
+				}
+				q.set(x, y, distance != 2 && distance != 4)
+			}
+		}
+	}
+
+	positions := qrAlignmentPositions(version)
+	last := len(positions) - 1
+	for i, cx := range positions {
+		for j, cy := range positions {
+			// Overlapping the finder patterns
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					distance := abs(dx)
+					if abs(dy) > distance {
+						distance = abs(dy)
+					}
+					q.set(cx+dx, cy+dy, distance != 1)
+				}
+			}
+		}
+	}
+
+	// Reserve the format areas, drawn once the mask is known
+	q.drawFormat(0)
+
+	if version >= 7 {
+		remainder := version
+		for i := 0; i < 12; i++ {
+			remainder = remainder<<1 ^ (remainder>>11)*0x1f25
+		}
+		bits := version<<12 | remainder
+		for i := 0; i < 18; i++ {
+			dark := bits>>uint(i)&1 == 1
+			a, b := q.size-11+i%3, i/3
+			q.set(a, b, dark)
+			q.set(b, a, dark)
+		}
+	}
+}
+
+// drawFormat - Error correction level and mask, twice
+func (q *qrCode) drawFormat(mask int) {
+	data := qrLevelM<<3 | mask
+	remainder := data
+	for i := 0; i < 10; i++ {
+		remainder = remainder<<1 ^ (remainder>>9)*0x537
+	}
+	bits := (data<<10 | remainder) ^ 0x5412
+	bit := func(i int) bool {
+		return bits>>uint(i)&1 == 1
+	}
+
+	for i := 0; i <= 5; i++ {
+		q.set(8, i, bit(i))
+	}
+	q.set(8, 7, bit(6))
+	q.set(8, 8, bit(7))
+	q.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.set(14-i, 8, bit(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		q.set(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.set(8, q.size-15+i, bit(i))
+	}
+	q.set(8, q.size-8, true)
+}
+
+// drawCodewords - Place the codewords in the zigzag from the bottom right,
+// skipping function modules
+func (q *qrCode) drawCodewords(codewords []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < q.size; vert++ {
+			y := vert
+			if upward {
+				y = q.size - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				x := right - j
+				if q.function[y][x] || i >= len(codewords)*8 {
+					continue
+				}
+				q.modules[y][x] = codewords[i/8]>>uint(7-i%8)&1 == 1
+				i++
+			}
+		}
+	}
+}
+
+// applyMask - Invert the data modules selected by the mask pattern, applying
+// it again undoes it
+func (q *qrCode) applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !q.function[y][x] {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty - How hard the code is to scan, lower is better
+func (q *qrCode) penalty() int {
+	score := 0
+	finder := []bool{true, false, true, true, true, false, true}
+
+	// Rows and columns alike
+	line := func(i int, transpose bool) []bool {
+		modules := make([]bool, q.size)
+		for j := range modules {
+			if transpose {
+				modules[j] = q.modules[j][i]
+			} else {
+				modules[j] = q.modules[i][j]
+			}
+		}
+		return modules
+	}
+	light := func(modules []bool, from int, to int) bool {
+		for i := from; i < to; i++ {
+			if i >= 0 && i < len(modules) && modules[i] {
+				return false
+			}
+		}
+		return true
+	}
+	for i := 0; i < q.size; i++ {
+		for _, transpose := range []bool{false, true} {
+			modules := line(i, transpose)
+
+			// Runs of five or more modules of the same colour
+			run := 1
+			for j := 1; j <= len(modules); j++ {
+				if j < len(modules) && modules[j] == modules[j-1] {
+					run++
+					continue
+				}
+				if run >= 5 {
+					score += run - 2
+				}
+				run = 1
+			}
+
+			// Finder-like patterns with four light modules on either side
+			for j := 0; j+len(finder) <= len(modules); j++ {
+				match := true
+				for k, dark := range finder {
+					if modules[j+k] != dark {
+						match = false
+						break
+					}
+				}
+				if match && (light(modules, j-4, j) || light(modules, j+7, j+11)) {
+					score += 40
+				}
+			}
+		}
+	}
+
+	// 2x2 blocks of the same colour
+	dark := 0
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.modules[y][x] {
+				dark++
+			}
+			if x+1 < q.size && y+1 < q.size {
+				c := q.modules[y][x]
+				if q.modules[y][x+1] == c && q.modules[y+1][x] == c && q.modules[y+1][x+1] == c {
+					score += 3
+				}
+			}
+		}
+	}
+
+	// Every 5% the dark modules deviate from half
+	total := q.size * q.size
+	score += abs(dark*100/total-50) / 5 * 10
+	return score
+}
+
+// encodeQRCode - data in the smallest version that fits, with the mask
+// pattern easiest to scan
+func encodeQRCode(data []byte) (*qrCode, error) {
+	for version := 1; version <= qrMaxVersion; version++ {
+		header := 12
+		if version > 9 {
+			header = 20
+		}
+		if header+len(data)*8 > qrDataCodewords(version)*8 {
+			continue
+		}
+
+		var best *qrCode
+		bestPenalty := 0
+		for mask := 0; mask < 8; mask++ {
+			q := newQRCode(data, version, mask)
+			if penalty := q.penalty(); best == nil || penalty < bestPenalty {
+				best, bestPenalty = q, penalty
+			}
+		}
+		return best, nil
+	}
+	return nil, fmt.Errorf("%d bytes don't fit in a QR code", len(data))
+}
+
+// lines - The code drawn with UTF-8 half blocks, two rows of modules per
+// line with a quiet zone of margin modules. Like qrencode the blocks are
+// the light modules, for terminals with a dark background.
+func (q *qrCode) lines(margin int) []string {
+	lightAt := func(x, y int) bool {
+		x, y = x-margin, y-margin
+		if x < 0 || x >= q.size || y < 0 || y >= q.size {
+			return true
+		}
+		return !q.modules[y][x]
+	}
+
+	width := q.size + 2*margin
+	var lines []string
+	for y := 0; y < width; y += 2 {
+		var line bytes.Buffer
+		for x := 0; x < width; x++ {
+			top, bottom := lightAt(x, y), y+1 < width && lightAt(x, y+1)
+			switch {
+			case top && bottom:
+				line.WriteString("█")
+			case top:
+				line.WriteString("▀")
+			case bottom:
+				line.WriteString("▄")
+			default:
+				line.WriteString(" ")
+			}
+		}
+		lines = append(lines, line.String())
+	}
+	return lines
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// renderQRCode - data as a QR code drawn with UTF-8 half blocks
+func renderQRCode(data string) ([]string, error) {
+	q, err := encodeQRCode([]byte(data))
+	if err != nil {
+		return nil, err
+	}
+	return q.lines(2), nil
+}
+
+// printLoginQRCode - Show loginURL as a QR code to scan with the app. Falls
+// back to printing the URL.
+func printLoginQRCode(out io.Writer, loginURL string) {
+	lines, err := renderQRCode(loginURL)
+	if err != nil {
+		fmt.Fprintln(out, fmt.Sprintf("Could not render QR code (%s), open this URL on your device instead:", err))
+		fmt.Fprintln(out, loginURL)
+		return
+	}
+
+	middle := len(lines) / 2
+	for i, line := range lines {
+		if i == middle {
+			line = fmt.Sprintf("%s  %s", line, "Scan with the Trusted Key App")
+		}
+		fmt.Fprintln(out, line)
+	}
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2017, Trusted Key
+This file is part of Trusted Key SSH-Agent.
+
+Trusted Key SSH-Agent is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Trusted Key SSH-Agent is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Trusted Key SSH-Agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestQRCodeMatchesReference(t *testing.T) {
+	// Version 1-M with mask 2 as encoded by rsc.io/qr
+	expected := []string{
+		"#######...##..#######",
+		"#.....#..##...#.....#",
+		"#.###.#.##..#.#.###.#",
+		"#.###.#.##.#..#.###.#",
+		"#.###.#.#.###.#.###.#",
+		"#.....#.#.#.#.#.....#",
+		"#######.#.#.#.#######",
+		"........##.##........",
+		"#.#####...#.#.#####..",
+		".###.#.##.#.#..##...#",
+		".#.##.#.##.#.#...#.#.",
+		".##..#.####..#....#..",
+		"#.#..##..###..#.#..#.",
+		"........#...##.###.##",
+		"#######.....####.###.",
+		"#.....#.#...##.#.##..",
+		"#.###.#.#.###.####.##",
+		"#.###.#.#..#.#.##.#..",
+		"#.###.#.#.####...#...",
+		"#.....#......#..###..",
+		"#######.##.#..##.#.#.",
+	}
+
+	q := newQRCode([]byte("tk-ssh-agent"), 1, 2)
+	for y, row := range q.modules {
+		var line []string
+		for _, dark := range row {
+			if dark {
+				line = append(line, "#")
+			} else {
+				line = append(line, ".")
+			}
+		}
+		if got := strings.Join(line, ""); got != expected[y] {
+			t.Errorf("row %d: expected %s, got %s", y, expected[y], got)
+		}
+	}
+}
+
+func TestEncodeQRCodeVersion(t *testing.T) {
+	for _, test := range []struct {
+		length  int
+		version int
+	}{
+		{14, 1}, // Largest for 1-M
+		{15, 2},
+		{180, 9}, // Last version with an 8 bit length
+		{181, 10},
+		{2331, 40},
+	} {
+		q, err := encodeQRCode(make([]byte, test.length))
+		if err != nil {
+			t.Fatalf("%d bytes: %s", test.length, err)
+		}
+		if q.size != test.version*4+17 {
+			t.Errorf("%d bytes: expected version %d, got size %d", test.length, test.version, q.size)
+		}
+	}
+
+	if _, err := encodeQRCode(make([]byte, 2332)); err == nil {
+		t.Error("expected data too large for version 40 to fail")
+	}
+}
+
+func TestQRCodeLines(t *testing.T) {
+	q := newQRCode([]byte("tk-ssh-agent"), 1, 2)
+	lines := q.lines(2)
+	// 25 rows of modules, two per line
+	if len(lines) != 13 {
+		t.Fatalf("expected 13 lines, got %d", len(lines))
+	}
+	for i, line := range lines {
+		if n := len([]rune(line)); n != 25 {
+			t.Errorf("line %d: expected 25 characters, got %d", i, n)
+		}
+	}
+	// Quiet zone above the top left finder pattern, its dark top row below
+	if !strings.HasPrefix(lines[0], "███████") || !strings.HasPrefix(lines[1], "██ ▄▄▄▄▄ █") {
+		t.Errorf("unexpected top left corner:\n%s\n%s", lines[0], lines[1])
+	}
+}
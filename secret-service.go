@@ -0,0 +1,337 @@
+/*
+Copyright 2017, Trusted Key
+This file is part of Trusted Key SSH-Agent.
+
+Trusted Key SSH-Agent is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Trusted Key SSH-Agent is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Trusted Key SSH-Agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The freedesktop Secret Service (GNOME Keyring, KWallet) over D-Bus:
+// https://specifications.freedesktop.org/secret-service/
+
+const (
+	secretsName                = "org.freedesktop.secrets"
+	secretsPath                = "/org/freedesktop/secrets"
+	secretsServiceInterface    = "org.freedesktop.Secret.Service"
+	secretsCollectionInterface = "org.freedesktop.Secret.Collection"
+	secretsItemInterface       = "org.freedesktop.Secret.Item"
+	secretsPromptInterface     = "org.freedesktop.Secret.Prompt"
+
+	// Where new items go, usually the "login" keyring
+	secretsDefaultCollection = "/org/freedesktop/secrets/aliases/default"
+
+	// Attribute identifying our items, as in "secret-tool lookup service tk-ssh-agent"
+	secretsServiceAttribute = "tk-ssh-agent"
+)
+
+// How long the user has to answer an unlock prompt
+var secretsPromptTimeout = 2 * time.Minute
+
+// secretService - A session with the Secret Service, secrets are
+// transferred unencrypted as the bus is local to the user
+type secretService struct {
+	conn    *dbusConn
+	session string
+}
+
+// openSecretService - Connect to the Secret Service on the session bus
+func openSecretService() (*secretService, error) {
+	conn, err := dialSessionBus()
+	if err != nil {
+		return nil, err
+	}
+
+	body := &dbusEncoder{}
+	body.string("plain")
+	body.variant("s", func() { body.string("") })
+	reply, err := conn.Call(secretsName, secretsPath, secretsServiceInterface, "OpenSession", "sv", body.buf)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	d, err := reply.decoder("vo")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	d.variant()
+	session := d.string()
+	if d.err != nil {
+		conn.Close()
+		return nil, d.err
+	}
+
+	return &secretService{conn: conn, session: session}, nil
+}
+
+// Close - End the session
+func (s *secretService) Close() {
+	s.conn.Call(secretsName, s.session, "org.freedesktop.Secret.Session", "Close", "", nil)
+	s.conn.Close()
+}
+
+// attributes - Encode the lookup attributes of the item for clientID as a{ss}
+func secretsAttributes(e *dbusEncoder, clientID string) {
+	e.array(8, func() {
+		for _, attribute := range [][2]string{{"service", secretsServiceAttribute}, {"account", clientID}} {
+			e.align(8)
+			e.string(attribute[0])
+			e.string(attribute[1])
+		}
+	})
+}
+
+// prompt - Let the user answer a prompt (e.g. for the keyring password),
+// "/" means none is needed
+func (s *secretService) prompt(path string) error {
+	if path == "/" {
+		return nil
+	}
+
+	completed := make(chan bool, 1)
+	s.conn.OnSignal(func(m *dbusMessage) {
+		if m.Path != path || m.Interface != secretsPromptInterface || m.Member != "Completed" {
+			return
+		}
+		d, err := m.decoder("bv")
+		if err != nil {
+			return
+		}
+		select {
+		case completed <- d.bool():
+		default:
+		}
+	})
+	defer s.conn.OnSignal(nil)
+
+	err := s.conn.AddMatch("type='signal',interface='" + secretsPromptInterface + "',member='Completed',path='" + path + "'")
+	if err != nil {
+		return err
+	}
+
+	body := &dbusEncoder{}
+	body.string("") // No parent window
+	if _, err := s.conn.Call(secretsName, path, secretsPromptInterface, "Prompt", "s", body.buf); err != nil {
+		return err
+	}
+
+	select {
+	case dismissed := <-completed:
+		if dismissed {
+			return errors.New("Secret Service prompt was dismissed")
+		}
+		return nil
+	case <-time.After(secretsPromptTimeout):
+		return errors.New("Secret Service prompt timed out")
+	}
+}
+
+// unlock - Unlock items or collections, prompting the user if needed
+func (s *secretService) unlock(paths []string) error {
+	body := &dbusEncoder{}
+	body.strings(paths)
+	reply, err := s.conn.Call(secretsName, secretsPath, secretsServiceInterface, "Unlock", "ao", body.buf)
+	if err != nil {
+		return err
+	}
+	d, err := reply.decoder("aoo")
+	if err != nil {
+		return err
+	}
+	d.strings()
+	prompt := d.string()
+	if d.err != nil {
+		return d.err
+	}
+	return s.prompt(prompt)
+}
+
+// search - Items stored for clientID, unlocked
+func (s *secretService) search(clientID string) ([]string, error) {
+	body := &dbusEncoder{}
+	secretsAttributes(body, clientID)
+	reply, err := s.conn.Call(secretsName, secretsPath, secretsServiceInterface, "SearchItems", "a{ss}", body.buf)
+	if err != nil {
+		return nil, err
+	}
+	d, err := reply.decoder("aoao")
+	if err != nil {
+		return nil, err
+	}
+	unlocked := d.strings()
+	locked := d.strings()
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	if len(locked) > 0 {
+		if err := s.unlock(locked); err != nil {
+			return nil, err
+		}
+	}
+	return append(unlocked, locked...), nil
+}
+
+// get - The secret of an unlocked item
+func (s *secretService) get(item string) (string, error) {
+	body := &dbusEncoder{}
+	body.string(s.session)
+	reply, err := s.conn.Call(secretsName, item, secretsItemInterface, "GetSecret", "o", body.buf)
+	if err != nil {
+		return "", err
+	}
+	d, err := reply.decoder("(oayays)")
+	if err != nil {
+		return "", err
+	}
+	d.align(8)
+	d.string()    // Session
+	d.byteArray() // Parameters, none for "plain"
+	value := d.byteArray()
+	d.string() // Content type
+	if d.err != nil {
+		return "", d.err
+	}
+	return string(value), nil
+}
+
+// create - Store secret for clientID in the default collection, replacing
+// an existing item
+func (s *secretService) create(clientID string, secret string) error {
+	if err := s.unlock([]string{secretsDefaultCollection}); err != nil {
+		return err
+	}
+
+	body := &dbusEncoder{}
+	body.array(8, func() {
+		body.align(8)
+		body.string("org.freedesktop.Secret.Item.Label")
+		body.variant("s", func() { body.string(fmt.Sprintf("Trusted Key SSH Agent (%s)", clientID)) })
+		body.align(8)
+		body.string("org.freedesktop.Secret.Item.Attributes")
+		body.variant("a{ss}", func() { secretsAttributes(body, clientID) })
+	})
+	body.align(8)
+	body.string(s.session)
+	body.byteArray(nil)
+	body.byteArray([]byte(secret))
+	body.string("text/plain")
+	body.bool(true)
+
+	reply, err := s.conn.Call(secretsName, secretsDefaultCollection, secretsCollectionInterface, "CreateItem", "a{sv}(oayays)b", body.buf)
+	if err != nil {
+		return err
+	}
+	d, err := reply.decoder("oo")
+	if err != nil {
+		return err
+	}
+	d.string()
+	prompt := d.string()
+	if d.err != nil {
+		return d.err
+	}
+	return s.prompt(prompt)
+}
+
+// delete - Remove an item, prompting the user if needed
+func (s *secretService) delete(item string) error {
+	reply, err := s.conn.Call(secretsName, item, secretsItemInterface, "Delete", "", nil)
+	if err != nil {
+		return err
+	}
+	d, err := reply.decoder("o")
+	if err != nil {
+		return err
+	}
+	prompt := d.string()
+	if d.err != nil {
+		return d.err
+	}
+	return s.prompt(prompt)
+}
+
+// secretServiceLookup - Fetch a client secret from the Secret Service
+func secretServiceLookup(clientID string) (string, error) {
+	s, err := openSecretService()
+	if err != nil {
+		return "", fmt.Errorf("Secret Service lookup failed: %s", err)
+	}
+	defer s.Close()
+
+	items, err := s.search(clientID)
+	if err != nil {
+		return "", fmt.Errorf("Secret Service lookup failed: %s", err)
+	}
+	if len(items) == 0 {
+		return "", errors.New("Secret Service has no secret for this identity")
+	}
+	secret, err := s.get(items[0])
+	if err != nil {
+		return "", fmt.Errorf("Secret Service lookup failed: %s", err)
+	}
+	return secret, nil
+}
+
+// secretServiceStore - Save a client secret in the Secret Service
+func secretServiceStore(clientID string, secret string) error {
+	s, err := openSecretService()
+	if err != nil {
+		return fmt.Errorf("Secret Service store failed: %s", err)
+	}
+	defer s.Close()
+
+	if err := s.create(clientID, secret); err != nil {
+		return fmt.Errorf("Secret Service store failed: %s", err)
+	}
+	return nil
+}
+
+// secretServiceDelete - Remove the client secret of clientID from the
+// Secret Service, if there is one
+func secretServiceDelete(clientID string) error {
+	s, err := openSecretService()
+	if err != nil {
+		return fmt.Errorf("Secret Service delete failed: %s", err)
+	}
+	defer s.Close()
+
+	items, err := s.search(clientID)
+	if err != nil {
+		return fmt.Errorf("Secret Service delete failed: %s", err)
+	}
+	for _, item := range items {
+		if err := s.delete(item); err != nil {
+			return fmt.Errorf("Secret Service delete failed: %s", err)
+		}
+	}
+	return nil
+}
+
+// secretServiceAvailable - Whether secrets can be kept in the Secret Service
+func secretServiceAvailable() bool {
+	s, err := openSecretService()
+	if err != nil {
+		return false
+	}
+	s.Close()
+	return true
+}
@@ -0,0 +1,333 @@
+/*
+Copyright 2017, Trusted Key
+This file is part of Trusted Key SSH-Agent.
+
+Trusted Key SSH-Agent is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Trusted Key SSH-Agent is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Trusted Key SSH-Agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const fakeSecretsPrompt = "/org/freedesktop/secrets/prompt/p1"
+
+// fakeSecretService - Items kept in memory, optionally locked behind a prompt
+type fakeSecretService struct {
+	bus *fakeBus
+
+	mutex   sync.Mutex
+	items   map[string]string // Secret by account
+	paths   map[string]string // Account by item path
+	locked  bool
+	dismiss bool // Dismiss the unlock prompt
+	prompts int
+	closed  bool
+}
+
+func newFakeSecretService(t *testing.T) *fakeSecretService {
+	s := &fakeSecretService{
+		bus:   newFakeBus(t),
+		items: make(map[string]string),
+		paths: make(map[string]string),
+	}
+	bus := s.bus
+
+	bus.Handle(secretsServiceInterface, "OpenSession", func(m *dbusMessage) (string, []byte, error) {
+		d, err := m.decoder("sv")
+		if err != nil {
+			return "", nil, err
+		}
+		if algorithm := d.string(); algorithm != "plain" {
+			return "", nil, errors.New("org.freedesktop.DBus.Error.NotSupported")
+		}
+		e := &dbusEncoder{}
+		e.variant("s", func() { e.string("") })
+		e.string("/org/freedesktop/secrets/session/s1")
+		return "vo", e.buf, nil
+	})
+
+	bus.Handle("org.freedesktop.Secret.Session", "Close", func(m *dbusMessage) (string, []byte, error) {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.closed = true
+		return "", nil, nil
+	})
+
+	bus.Handle(secretsServiceInterface, "SearchItems", func(m *dbusMessage) (string, []byte, error) {
+		d, err := m.decoder("a{ss}")
+		if err != nil {
+			return "", nil, err
+		}
+		attributes := readStringMap(d)
+
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		var found []string
+		if _, ok := s.items[attributes["account"]]; ok && attributes["service"] == secretsServiceAttribute {
+			found = append(found, s.path(attributes["account"]))
+		}
+		e := &dbusEncoder{}
+		if s.locked {
+			e.strings(nil)
+			e.strings(found)
+		} else {
+			e.strings(found)
+			e.strings(nil)
+		}
+		return "aoao", e.buf, nil
+	})
+
+	bus.Handle(secretsServiceInterface, "Unlock", func(m *dbusMessage) (string, []byte, error) {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		e := &dbusEncoder{}
+		e.strings(nil)
+		if s.locked {
+			e.string(fakeSecretsPrompt)
+		} else {
+			e.string("/")
+		}
+		return "aoo", e.buf, nil
+	})
+
+	bus.Handle(secretsPromptInterface, "Prompt", func(m *dbusMessage) (string, []byte, error) {
+		if m.Path != fakeSecretsPrompt {
+			return "", nil, errors.New("org.freedesktop.DBus.Error.UnknownObject")
+		}
+		s.mutex.Lock()
+		s.prompts++
+		dismiss := s.dismiss
+		if !dismiss {
+			s.locked = false
+		}
+		s.mutex.Unlock()
+
+		e := &dbusEncoder{}
+		e.bool(dismiss)
+		e.variant("ao", func() { e.strings(nil) })
+		go bus.Emit(fakeSecretsPrompt, secretsPromptInterface, "Completed", "bv", e.buf)
+		return "", nil, nil
+	})
+
+	bus.Handle(secretsItemInterface, "GetSecret", func(m *dbusMessage) (string, []byte, error) {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		account, ok := s.paths[m.Path]
+		if !ok {
+			return "", nil, errors.New("org.freedesktop.Secret.Error.NoSuchObject")
+		}
+		if s.locked {
+			return "", nil, errors.New("org.freedesktop.Secret.Error.IsLocked")
+		}
+		e := &dbusEncoder{}
+		e.align(8)
+		e.string("/org/freedesktop/secrets/session/s1")
+		e.byteArray(nil)
+		e.byteArray([]byte(s.items[account]))
+		e.string("text/plain")
+		return "(oayays)", e.buf, nil
+	})
+
+	bus.Handle(secretsCollectionInterface, "CreateItem", func(m *dbusMessage) (string, []byte, error) {
+		if m.Path != secretsDefaultCollection {
+			return "", nil, errors.New("org.freedesktop.Secret.Error.NoSuchObject")
+		}
+		d, err := m.decoder("a{sv}(oayays)b")
+		if err != nil {
+			return "", nil, err
+		}
+		var attributes map[string]string
+		length := int(d.uint32())
+		d.align(8)
+		end := d.pos + length
+		for d.err == nil && d.pos < end {
+			d.align(8)
+			key := d.string()
+			switch signature := d.signature(); signature {
+			case "s":
+				d.string()
+			case "a{ss}":
+				if key == "org.freedesktop.Secret.Item.Attributes" {
+					attributes = readStringMap(d)
+				}
+			default:
+				return "", nil, fmt.Errorf("unexpected property type %s", signature)
+			}
+		}
+		d.align(8)
+		d.string()
+		d.byteArray()
+		secret := d.byteArray()
+		d.string()
+		replace := d.bool()
+		if d.err != nil {
+			return "", nil, d.err
+		}
+		if !replace || attributes["service"] != secretsServiceAttribute {
+			return "", nil, errors.New("org.freedesktop.DBus.Error.InvalidArgs")
+		}
+
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if s.locked {
+			return "", nil, errors.New("org.freedesktop.Secret.Error.IsLocked")
+		}
+		s.items[attributes["account"]] = string(secret)
+		e := &dbusEncoder{}
+		e.string(s.path(attributes["account"]))
+		e.string("/")
+		return "oo", e.buf, nil
+	})
+
+	bus.Handle(secretsItemInterface, "Delete", func(m *dbusMessage) (string, []byte, error) {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		account, ok := s.paths[m.Path]
+		if !ok {
+			return "", nil, errors.New("org.freedesktop.Secret.Error.NoSuchObject")
+		}
+		if s.locked {
+			return "", nil, errors.New("org.freedesktop.Secret.Error.IsLocked")
+		}
+		delete(s.items, account)
+		delete(s.paths, m.Path)
+		e := &dbusEncoder{}
+		e.string("/")
+		return "o", e.buf, nil
+	})
+
+	return s
+}
+
+func (s *fakeSecretService) path(account string) string {
+	path := "/org/freedesktop/secrets/collection/login/" + strings.Replace(account, "-", "_", -1)
+	s.paths[path] = account
+	return path
+}
+
+func (s *fakeSecretService) Close() {
+	s.bus.Close()
+}
+
+func TestSecretServiceRoundTrip(t *testing.T) {
+	s := newFakeSecretService(t)
+	defer s.Close()
+
+	if err := secretServiceStore("client-1", "secret 1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := secretServiceStore("client-2", "secret 2"); err != nil {
+		t.Fatal(err)
+	}
+	// Replaces the existing item
+	if err := secretServiceStore("client-1", "secret 1b"); err != nil {
+		t.Fatal(err)
+	}
+
+	for clientID, expected := range map[string]string{"client-1": "secret 1b", "client-2": "secret 2"} {
+		secret, err := secretServiceLookup(clientID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if secret != expected {
+			t.Errorf("%s: expected %q, got %q", clientID, expected, secret)
+		}
+	}
+
+	if _, err := secretServiceLookup("client-3"); err == nil || !strings.Contains(err.Error(), "has no secret") {
+		t.Errorf("expected a missing secret error, got %v", err)
+	}
+
+	s.mutex.Lock()
+	closed := s.closed
+	s.mutex.Unlock()
+	if !closed {
+		t.Error("session wasn't closed")
+	}
+}
+
+func TestSecretServiceDelete(t *testing.T) {
+	s := newFakeSecretService(t)
+	defer s.Close()
+	s.items["client-1"] = "secret 1"
+	s.items["client-2"] = "secret 2"
+	s.locked = true
+
+	if err := secretServiceDelete("client-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := secretServiceLookup("client-1"); err == nil || !strings.Contains(err.Error(), "has no secret") {
+		t.Errorf("expected the secret to be gone, got %v", err)
+	}
+	if secret, err := secretServiceLookup("client-2"); err != nil || secret != "secret 2" {
+		t.Errorf("expected the other secret to be kept, got %q, %v", secret, err)
+	}
+	// Nothing to delete
+	if err := secretServiceDelete("client-1"); err != nil {
+		t.Errorf("expected deleting a missing secret to succeed, got %v", err)
+	}
+}
+
+func TestSecretServiceUnlockPrompt(t *testing.T) {
+	s := newFakeSecretService(t)
+	defer s.Close()
+	s.items["client-1"] = "secret"
+	s.locked = true
+
+	secret, err := secretServiceLookup("client-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret != "secret" {
+		t.Errorf("expected %q, got %q", "secret", secret)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.prompts != 1 {
+		t.Errorf("expected one prompt, got %d", s.prompts)
+	}
+}
+
+func TestSecretServiceDismissedPrompt(t *testing.T) {
+	s := newFakeSecretService(t)
+	defer s.Close()
+	s.items["client-1"] = "secret"
+	s.locked = true
+	s.dismiss = true
+
+	if _, err := secretServiceLookup("client-1"); err == nil || !strings.Contains(err.Error(), "dismissed") {
+		t.Errorf("expected the prompt to be dismissed, got %v", err)
+	}
+	if err := secretServiceStore("client-2", "secret"); err == nil || !strings.Contains(err.Error(), "dismissed") {
+		t.Errorf("expected the prompt to be dismissed, got %v", err)
+	}
+}
+
+func TestSecretServiceUnavailable(t *testing.T) {
+	bus := newFakeBus(t)
+	defer bus.Close()
+
+	if secretServiceAvailable() {
+		t.Error("expected the Secret Service to be unavailable on a bus without it")
+	}
+	if _, err := secretServiceLookup("client-1"); err == nil {
+		t.Error("expected lookup to fail")
+	}
+}
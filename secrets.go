@@ -0,0 +1,305 @@
+/*
+Copyright 2017, Trusted Key
+This file is part of Trusted Key SSH-Agent.
+
+Trusted Key SSH-Agent is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Trusted Key SSH-Agent is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Trusted Key SSH-Agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/crypto/ssh/terminal"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// Where enroll stores new client secrets
+const (
+	secretStorePassphrase    = "passphrase"
+	secretStoreSecretService = "secret-service"
+	secretStorePlaintext     = "plaintext"
+)
+
+// ErrWrongPassphrase - Returned when a secret could not be decrypted
+var ErrWrongPassphrase = errors.New("wrong passphrase or corrupted secret")
+
+// SealedSecret - A client secret encrypted with AES-256-GCM using a key
+// derived from a passphrase with scrypt
+type SealedSecret struct {
+	KDF        string `json:"kdf"`
+	Salt       []byte `json:"salt"`
+	N          int    `json:"n"`
+	R          int    `json:"r"`
+	P          int    `json:"p"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// secretAAD - Bind a sealed secret to the identity it belongs to
+func secretAAD(pubkey string, identity *IdentityConfig) []byte {
+	return []byte(pubkey + "\x00" + identity.ClientID)
+}
+
+func (s *SealedSecret) aead(passphrase []byte) (cipher.AEAD, error) {
+	if s.KDF != "scrypt" {
+		return nil, fmt.Errorf("unsupported kdf %q", s.KDF)
+	}
+	key, err := scrypt.Key(passphrase, s.Salt, s.N, s.R, s.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealSecret - Encrypt secret with passphrase
+func sealSecret(passphrase []byte, secret string, aad []byte) (*SealedSecret, error) {
+	sealed := &SealedSecret{
+		KDF:  "scrypt",
+		Salt: make([]byte, 16),
+		N:    1 << 15,
+		R:    8,
+		P:    1,
+	}
+	if _, err := rand.Read(sealed.Salt); err != nil {
+		return nil, err
+	}
+
+	aead, err := sealed.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(sealed.Nonce); err != nil {
+		return nil, err
+	}
+	sealed.Ciphertext = aead.Seal(nil, sealed.Nonce, []byte(secret), aad)
+
+	return sealed, nil
+}
+
+// Open - Decrypt the secret with passphrase
+func (s *SealedSecret) Open(passphrase []byte, aad []byte) (string, error) {
+	aead, err := s.aead(passphrase)
+	if err != nil {
+		return "", err
+	}
+	if len(s.Nonce) != aead.NonceSize() {
+		return "", ErrWrongPassphrase
+	}
+
+	secret, err := aead.Open(nil, s.Nonce, s.Ciphertext, aad)
+	if err != nil {
+		return "", ErrWrongPassphrase
+	}
+	return string(secret), nil
+}
+
+// defaultSecretStore - The Secret Service if there is one, the agent can
+// then start without a terminal, a passphrase otherwise
+func defaultSecretStore() string {
+	if secretServiceAvailable() {
+		return secretStoreSecretService
+	}
+	return secretStorePassphrase
+}
+
+// isTerminal - Check if f is attached to a terminal
+func isTerminal(f *os.File) bool {
+	return terminal.IsTerminal(int(f.Fd()))
+}
+
+// readPassphrase - Prompt for a passphrase on the terminal without echo,
+// or run passphraseCommand (which prints it on stdout) if there is none
+func readPassphrase(prompt string, passphraseCommand string) ([]byte, error) {
+	if !isTerminal(os.Stdin) {
+		if passphraseCommand == "" {
+			return nil, errors.New("No terminal to ask for the passphrase and no passphraseCommand configured")
+		}
+		out, err := exec.Command("sh", "-c", passphraseCommand).Output()
+		if err != nil {
+			return nil, fmt.Errorf("passphraseCommand failed: %s", err)
+		}
+		return bytes.TrimRight(out, "\n"), nil
+	}
+
+	// Turn echo back on when interrupted
+	fd := int(os.Stdin.Fd())
+	state, err := terminal.GetState(fd)
+	if err != nil {
+		return nil, err
+	}
+	interrupt := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+	defer close(done)
+	go func() {
+		select {
+		case <-interrupt:
+			terminal.Restore(fd, state)
+			fmt.Fprintln(os.Stderr)
+			os.Exit(130)
+		case <-done:
+		}
+	}()
+
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	return passphrase, err
+}
+
+// Secrets resolves client secrets however they are stored, asking for
+// the passphrase at most once
+type Secrets struct {
+	mutex             sync.Mutex
+	passphrase        []byte
+	passphraseCommand string
+}
+
+// NewSecrets - Resolver without any cached passphrase
+func NewSecrets() *Secrets {
+	return &Secrets{}
+}
+
+// SetPassphraseCommand - Command printing the passphrase, used when there
+// is no terminal to prompt on
+func (s *Secrets) SetPassphraseCommand(passphraseCommand string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.passphraseCommand = passphraseCommand
+}
+
+func (s *Secrets) getPassphrase(confirm bool) ([]byte, error) {
+	if s.passphrase != nil {
+		return s.passphrase, nil
+	}
+
+	passphrase, err := readPassphrase("Passphrase for Trusted Key secrets: ", s.passphraseCommand)
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("Empty passphrase")
+	}
+
+	if confirm {
+		again, err := readPassphrase("Repeat passphrase: ", s.passphraseCommand)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(passphrase, again) {
+			return nil, errors.New("Passphrases do not match")
+		}
+	}
+
+	s.passphrase = passphrase
+	return passphrase, nil
+}
+
+// Resolve - Get the plaintext client secret for an identity
+func (s *Secrets) Resolve(pubkey string, identity *IdentityConfig) (string, error) {
+	switch {
+	case identity.EncryptedSecret != nil:
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		passphrase, err := s.getPassphrase(false)
+		if err != nil {
+			return "", err
+		}
+		secret, err := identity.EncryptedSecret.Open(passphrase, secretAAD(pubkey, identity))
+		if err != nil {
+			// Let the user try again next time
+			s.passphrase = nil
+			return "", err
+		}
+		return secret, nil
+
+	case identity.SecretService:
+		return secretServiceLookup(identity.ClientID)
+
+	default:
+		return identity.ClientSecret, nil
+	}
+}
+
+// Store - Move the plaintext client secret of identity into store. Existing
+// encrypted secrets in config must open with the same passphrase.
+func (s *Secrets) Store(config *ConfigFile, pubkey string, identity *IdentityConfig, store string) error {
+	secret := identity.ClientSecret
+
+	switch store {
+	case secretStorePlaintext:
+		return nil
+
+	case secretStoreSecretService:
+		if err := secretServiceStore(identity.ClientID, secret); err != nil {
+			return err
+		}
+		identity.SecretService = true
+
+	case secretStorePassphrase:
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		// Verify against an existing secret so there is one passphrase per file
+		var existingKey string
+		var existing *IdentityConfig
+		for k, v := range config.Identities {
+			if v.EncryptedSecret != nil && k != pubkey {
+				existingKey, existing = k, v
+				break
+			}
+		}
+
+		passphrase, err := s.getPassphrase(existing == nil)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			if _, err := existing.EncryptedSecret.Open(passphrase, secretAAD(existingKey, existing)); err != nil {
+				s.passphrase = nil
+				return err
+			}
+		}
+
+		sealed, err := sealSecret(passphrase, secret, secretAAD(pubkey, identity))
+		if err != nil {
+			return err
+		}
+		identity.EncryptedSecret = sealed
+
+	default:
+		return fmt.Errorf("Unknown secret store '%s'", store)
+	}
+
+	identity.ClientSecret = ""
+	return nil
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2017, Trusted Key
+This file is part of Trusted Key SSH-Agent.
+
+Trusted Key SSH-Agent is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Trusted Key SSH-Agent is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Trusted Key SSH-Agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"testing"
+)
+
+func TestSealedSecretRoundTrip(t *testing.T) {
+	aad := []byte("pubkey\x00client")
+	sealed, err := sealSecret([]byte("passphrase"), "client secret", aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(sealed.Ciphertext) == "client secret" {
+		t.Fatal("secret is not encrypted")
+	}
+
+	secret, err := sealed.Open([]byte("passphrase"), aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret != "client secret" {
+		t.Errorf("expected %q, got %q", "client secret", secret)
+	}
+
+	if _, err := sealed.Open([]byte("wrong"), aad); err != ErrWrongPassphrase {
+		t.Errorf("wrong passphrase: expected %v, got %v", ErrWrongPassphrase, err)
+	}
+	// Moved to another identity
+	if _, err := sealed.Open([]byte("passphrase"), []byte("pubkey\x00other")); err != ErrWrongPassphrase {
+		t.Errorf("wrong identity: expected %v, got %v", ErrWrongPassphrase, err)
+	}
+
+	sealed.Nonce = sealed.Nonce[1:]
+	if _, err := sealed.Open([]byte("passphrase"), aad); err != ErrWrongPassphrase {
+		t.Errorf("corrupted nonce: expected %v, got %v", ErrWrongPassphrase, err)
+	}
+}
+
+func TestSecretsStorePassphrase(t *testing.T) {
+	config := NewConfigFile()
+	identity := &IdentityConfig{RpURL: "https://rp.example.com", ClientID: "client", ClientSecret: "secret"}
+	config.Identities[testPubKey] = identity
+
+	// Tests don't run on a terminal
+	secrets := NewSecrets()
+	secrets.SetPassphraseCommand("echo passphrase")
+	if err := secrets.Store(config, testPubKey, identity, secretStorePassphrase); err != nil {
+		t.Fatal(err)
+	}
+	if identity.ClientSecret != "" || identity.EncryptedSecret == nil {
+		t.Fatalf("secret not moved to the encrypted store: %+v", identity)
+	}
+	if errs := config.Validate("", nil); len(errs) > 0 {
+		t.Error(errs)
+	}
+
+	secrets = NewSecrets()
+	secrets.SetPassphraseCommand("echo passphrase")
+	secret, err := secrets.Resolve(testPubKey, identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret != "secret" {
+		t.Errorf("expected %q, got %q", "secret", secret)
+	}
+
+	// Another identity must use the same passphrase
+	other := &IdentityConfig{RpURL: "https://rp.example.com", ClientID: "other", ClientSecret: "secret"}
+	secrets = NewSecrets()
+	secrets.SetPassphraseCommand("echo different")
+	if err := secrets.Store(config, "04other", other, secretStorePassphrase); err != ErrWrongPassphrase {
+		t.Errorf("expected %v, got %v", ErrWrongPassphrase, err)
+	}
+}
@@ -0,0 +1,169 @@
+/*
+Copyright 2017, Trusted Key
+This file is part of Trusted Key SSH-Agent.
+
+Trusted Key SSH-Agent is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Trusted Key SSH-Agent is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Trusted Key SSH-Agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"os/user"
+	"path"
+	"strings"
+)
+
+const sessionBindExtension = "session-bind@openssh.com"
+
+// How many hosts a connection may be bound to, as in OpenSSH
+const maxSessionBinds = 16
+
+// ErrSessionMismatch - Returned from Sign when the data to sign belongs to
+// another session than the one the connection was bound to
+var ErrSessionMismatch = errors.New("agent: signature request for unbound session")
+
+// sessionBind is a destination host that ssh bound to an agent connection
+type sessionBind struct {
+	hostKey    ssh.PublicKey
+	sessionID  []byte
+	forwarding bool
+	hostnames  []string // Known hostnames for hostKey, if any
+}
+
+// parseSessionBind - Parse and verify a session-bind@openssh.com request
+func parseSessionBind(contents []byte) (*sessionBind, error) {
+	var msg struct {
+		HostKey    []byte
+		SessionID  []byte
+		Signature  []byte
+		Forwarding bool
+	}
+	if err := ssh.Unmarshal(contents, &msg); err != nil {
+		return nil, err
+	}
+
+	hostKey, err := ssh.ParsePublicKey(msg.HostKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var sig ssh.Signature
+	if err := ssh.Unmarshal(msg.Signature, &sig); err != nil {
+		return nil, err
+	}
+
+	// The host proves it owns the session by signing the session ID
+	if err := hostKey.Verify(msg.SessionID, &sig); err != nil {
+		return nil, fmt.Errorf("agent: invalid session-bind signature: %s", err)
+	}
+
+	return &sessionBind{
+		hostKey:    hostKey,
+		sessionID:  msg.SessionID,
+		forwarding: msg.Forwarding,
+		hostnames:  knownHostnames(hostKey),
+	}, nil
+}
+
+// Fingerprint - SHA256 fingerprint of the bound host key
+func (b *sessionBind) Fingerprint() string {
+	return ssh.FingerprintSHA256(b.hostKey)
+}
+
+// String - Human readable destination, e.g. "example.com (SHA256:...)"
+func (b *sessionBind) String() string {
+	if len(b.hostnames) == 0 {
+		return b.Fingerprint()
+	}
+	return fmt.Sprintf("%s (%s)", strings.Join(b.hostnames, ", "), b.Fingerprint())
+}
+
+// userAuthSessionID - Extract the session ID from a publickey
+// SSH_MSG_USERAUTH_REQUEST (RFC 4252 section 7), which is what ssh asks us to sign
+func userAuthSessionID(data []byte) ([]byte, bool) {
+	var msg struct {
+		SessionID []byte
+		Rest      []byte `ssh:"rest"`
+	}
+	if err := ssh.Unmarshal(data, &msg); err != nil {
+		return nil, false
+	}
+	// SSH_MSG_USERAUTH_REQUEST
+	if len(msg.Rest) == 0 || msg.Rest[0] != 50 {
+		return nil, false
+	}
+	return msg.SessionID, true
+}
+
+// checkSessionBind - Make sure data to be signed is a userauth request for
+// the session the connection was last bound to, only done for identities
+// restricted to some hosts
+func checkSessionBind(bind *sessionBind, data []byte) error {
+	if bind == nil {
+		return nil
+	}
+	sessionID, ok := userAuthSessionID(data)
+	if !ok || !bytes.Equal(sessionID, bind.sessionID) {
+		return ErrSessionMismatch
+	}
+	return nil
+}
+
+func knownHostsFiles() []string {
+	files := []string{"/etc/ssh/ssh_known_hosts"}
+	usr, err := user.Current()
+	if err == nil {
+		files = append(files, path.Join(usr.HomeDir, ".ssh", "known_hosts"))
+	}
+	return files
+}
+
+// knownHostnames - Look up the (unhashed) hostnames for key in known_hosts
+func knownHostnames(key ssh.PublicKey) []string {
+	wanted := key.Marshal()
+	var hostnames []string
+
+	for _, file := range knownHostsFiles() {
+		contents, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+
+		for len(contents) > 0 {
+			marker, hosts, pub, _, rest, err := ssh.ParseKnownHosts(contents)
+			if err != nil {
+				break
+			}
+			contents = rest
+
+			if marker == "revoked" || !bytes.Equal(pub.Marshal(), wanted) {
+				continue
+			}
+			for _, host := range hosts {
+				// Hashed entries can't be reversed
+				if strings.HasPrefix(host, "|") {
+					continue
+				}
+				hostnames = append(hostnames, host)
+			}
+		}
+	}
+
+	return hostnames
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2017, Trusted Key
+This file is part of Trusted Key SSH-Agent.
+
+Trusted Key SSH-Agent is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Trusted Key SSH-Agent is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Trusted Key SSH-Agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"testing"
+)
+
+// testSessionBind - A session-bind@openssh.com request from a new host key
+func testSessionBind(t *testing.T, sessionID []byte, forwarding bool) []byte {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := signer.Sign(rand.Reader, sessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ssh.Marshal(struct {
+		HostKey    []byte
+		SessionID  []byte
+		Signature  []byte
+		Forwarding bool
+	}{signer.PublicKey().Marshal(), sessionID, ssh.Marshal(sig), forwarding})
+}
+
+// testUserAuthRequest - The data ssh asks the agent to sign for publickey auth
+func testUserAuthRequest(sessionID []byte) []byte {
+	return ssh.Marshal(struct {
+		SessionID []byte
+		Type      byte
+		User      string
+		Service   string
+		Method    string
+		HasSig    bool
+		Algorithm string
+		PubKey    []byte
+	}{sessionID, 50, "me", "ssh-connection", "publickey", true, "ecdsa-sha2-nistp256", []byte("key")})
+}
+
+func TestCheckSessionBind(t *testing.T) {
+	bind, err := parseSessionBind(testSessionBind(t, []byte("session 1"), false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkSessionBind(bind, testUserAuthRequest([]byte("session 1"))); err != nil {
+		t.Errorf("expected the bound session to be accepted, got %v", err)
+	}
+	if err := checkSessionBind(bind, testUserAuthRequest([]byte("session 2"))); err != ErrSessionMismatch {
+		t.Errorf("expected another session to be rejected, got %v", err)
+	}
+	// e.g. SSHSIG for git commit signing
+	if err := checkSessionBind(bind, []byte("SSHSIG\x00\x00\x00\x03git")); err != ErrSessionMismatch {
+		t.Errorf("expected non-userauth data to be rejected, got %v", err)
+	}
+	if err := checkSessionBind(nil, []byte("anything")); err != nil {
+		t.Errorf("expected an unbound connection to be accepted, got %v", err)
+	}
+}
+
+func TestParseSessionBindBadSignature(t *testing.T) {
+	contents := testSessionBind(t, []byte("session 1"), false)
+	// Flip a byte of the signature at the end, before the forwarding flag
+	contents[len(contents)-2] ^= 0xff
+	if _, err := parseSessionBind(contents); err == nil {
+		t.Error("expected an invalid signature to be rejected")
+	}
+}
+
+func TestConnInfoBindLimit(t *testing.T) {
+	conn := &ConnInfo{}
+	bind, err := parseSessionBind(testSessionBind(t, []byte("session"), true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxSessionBinds; i++ {
+		if err := conn.addBind(bind); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := conn.addBind(bind); err == nil {
+		t.Error("expected binds beyond the limit to be refused")
+	}
+	if len(conn.Binds()) != maxSessionBinds {
+		t.Errorf("expected %d binds, got %d", maxSessionBinds, len(conn.Binds()))
+	}
+}
+
+func TestPolicyDestinationConstrained(t *testing.T) {
+	identity := TKIdentity{addr: "0x01", pubkey: []byte(testPubKey)}
+	other := TKIdentity{addr: "0x02", pubkey: []byte("other")}
+	policy := NewPolicy(map[string]*PolicyRule{
+		"0x01": {Hosts: []string{"*.example.com"}},
+		"*":    {Users: []string{"me"}},
+	})
+	if !policy.DestinationConstrained(identity) {
+		t.Error("expected an identity with host rules to be destination constrained")
+	}
+	if policy.DestinationConstrained(other) {
+		t.Error("expected an identity without host rules not to be destination constrained")
+	}
+	if NewPolicy(nil).DestinationConstrained(identity) {
+		t.Error("expected no policy not to constrain anything")
+	}
+}
+
+func TestConnAgentRefusesForwardedControl(t *testing.T) {
+	keyring := &proxykeyring{tkKeyRing: NewTKeyring(&AgentConfig{}), backendAgent: agent.NewKeyring()}
+
+	local := &ConnInfo{}
+	a := NewConnAgent(keyring, local)
+	if _, err := a.Extension(sessionBindExtension, testSessionBind(t, []byte("session"), false)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Extension(statusExtension, nil); err != nil {
+		t.Errorf("expected status on a local connection, got %v", err)
+	}
+
+	forwarded := &ConnInfo{}
+	a = NewConnAgent(keyring, forwarded)
+	if _, err := a.Extension(sessionBindExtension, testSessionBind(t, []byte("session"), true)); err != nil {
+		t.Fatal(err)
+	}
+	for _, extension := range []string{cancelExtension, enableExtension, statusExtension, dropExtension} {
+		if _, err := a.Extension(extension, nil); err != errForwardedControl {
+			t.Errorf("%s: expected a forwarded connection to be refused, got %v", extension, err)
+		}
+	}
+}
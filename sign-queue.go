@@ -0,0 +1,146 @@
+/*
+Copyright 2017, Trusted Key
+This file is part of Trusted Key SSH-Agent.
+
+Trusted Key SSH-Agent is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Trusted Key SSH-Agent is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Trusted Key SSH-Agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrSignCancelled - Returned from Sign when the user cancelled the request
+var ErrSignCancelled = errors.New("agent: signature request cancelled by user")
+
+// signQueue serializes signature requests for a single identity so the
+// user only ever has one prompt (and one code) to deal with at a time
+type signQueue struct {
+	slot chan struct{}
+
+	mutex     sync.Mutex
+	pending   int
+	cancelled chan struct{} // Closed and replaced by CancelAll
+}
+
+// queueTicket - A request that made it to the front of the queue
+type queueTicket struct {
+	ctx       context.Context
+	cancelled chan struct{}
+	leave     func()
+
+	cancelOnce sync.Once
+	cancelOne  chan struct{} // Closed by Cancel
+}
+
+func newSignQueue() *signQueue {
+	return &signQueue{
+		slot:      make(chan struct{}, 1),
+		cancelled: make(chan struct{}),
+	}
+}
+
+// Enter - Wait for our turn, the ticket must be released with Leave
+func (q *signQueue) Enter(ctx context.Context) (*queueTicket, error) {
+	q.mutex.Lock()
+	q.pending++
+	cancelled := q.cancelled
+	q.mutex.Unlock()
+
+	cancelOne := make(chan struct{})
+
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-cancelled:
+			cancel()
+		case <-cancelOne:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	ticket := &queueTicket{
+		ctx:       ctx,
+		cancelled: cancelled,
+		cancelOne: cancelOne,
+		leave: func() {
+			cancel()
+			q.mutex.Lock()
+			q.pending--
+			q.mutex.Unlock()
+		},
+	}
+
+	select {
+	case q.slot <- struct{}{}:
+	case <-ctx.Done():
+		ticket.leave()
+		return nil, ticket.Err()
+	}
+
+	leave := ticket.leave
+	ticket.leave = func() {
+		<-q.slot
+		leave()
+	}
+	return ticket, nil
+}
+
+// Pending - Number of requests waiting or in progress
+func (q *signQueue) Pending() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.pending
+}
+
+// CancelAll - Abort the running request and everything waiting behind it
+func (q *signQueue) CancelAll() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	close(q.cancelled)
+	q.cancelled = make(chan struct{})
+}
+
+// Context - Done when the request should be aborted
+func (t *queueTicket) Context() context.Context {
+	return t.ctx
+}
+
+// Err - Why the request was aborted, if it was
+func (t *queueTicket) Err() error {
+	select {
+	case <-t.cancelled:
+		return ErrSignCancelled
+	case <-t.cancelOne:
+		return ErrSignCancelled
+	default:
+		return t.ctx.Err()
+	}
+}
+
+// Cancel - Abort just this request
+func (t *queueTicket) Cancel() {
+	t.cancelOnce.Do(func() {
+		close(t.cancelOne)
+	})
+}
+
+// Leave - Let the next request in
+func (t *queueTicket) Leave() {
+	t.leave()
+}
@@ -0,0 +1,169 @@
+/*
+Copyright 2017, Trusted Key
+This file is part of Trusted Key SSH-Agent.
+
+Trusted Key SSH-Agent is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Trusted Key SSH-Agent is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Trusted Key SSH-Agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func enterAsync(ctx context.Context, q *signQueue) (chan *queueTicket, chan error) {
+	tickets := make(chan *queueTicket, 1)
+	errs := make(chan error, 1)
+	go func() {
+		ticket, err := q.Enter(ctx)
+		if err != nil {
+			errs <- err
+			return
+		}
+		tickets <- ticket
+	}()
+	return tickets, errs
+}
+
+func waitPending(t *testing.T, q *signQueue, n int) {
+	for i := 0; i < 100; i++ {
+		if q.Pending() == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected %d pending requests, got %d", n, q.Pending())
+}
+
+func TestSignQueueSerializes(t *testing.T) {
+	q := newSignQueue()
+	first, err := q.Enter(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tickets, errs := enterAsync(context.Background(), q)
+	waitPending(t, q, 2)
+	select {
+	case <-tickets:
+		t.Fatal("second request entered while the first was running")
+	case err := <-errs:
+		t.Fatal(err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	first.Leave()
+	select {
+	case second := <-tickets:
+		second.Leave()
+	case err := <-errs:
+		t.Fatal(err)
+	case <-time.After(time.Second):
+		t.Fatal("second request didn't enter after the first left")
+	}
+	waitPending(t, q, 0)
+}
+
+func TestSignQueueCancelAll(t *testing.T) {
+	q := newSignQueue()
+	first, err := q.Enter(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, errs := enterAsync(context.Background(), q)
+	waitPending(t, q, 2)
+
+	q.CancelAll()
+
+	select {
+	case <-first.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("running request wasn't aborted")
+	}
+	if first.Err() != ErrSignCancelled {
+		t.Errorf("running request: expected %v, got %v", ErrSignCancelled, first.Err())
+	}
+	select {
+	case err := <-errs:
+		if err != ErrSignCancelled {
+			t.Errorf("waiting request: expected %v, got %v", ErrSignCancelled, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiting request wasn't aborted")
+	}
+	first.Leave()
+
+	// Requests arriving later are not affected
+	next, err := q.Enter(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Err() != nil {
+		t.Errorf("new request: expected no error, got %v", next.Err())
+	}
+	next.Leave()
+	waitPending(t, q, 0)
+}
+
+func TestQueueTicketCancel(t *testing.T) {
+	q := newSignQueue()
+	first, err := q.Enter(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tickets, errs := enterAsync(context.Background(), q)
+	waitPending(t, q, 2)
+
+	first.Cancel()
+	first.Cancel()
+	select {
+	case <-first.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("cancelled request wasn't aborted")
+	}
+	if first.Err() != ErrSignCancelled {
+		t.Errorf("expected %v, got %v", ErrSignCancelled, first.Err())
+	}
+	first.Leave()
+
+	// Only the cancelled request is aborted
+	select {
+	case second := <-tickets:
+		if second.Err() != nil {
+			t.Errorf("next request: expected no error, got %v", second.Err())
+		}
+		second.Leave()
+	case err := <-errs:
+		t.Fatal(err)
+	case <-time.After(time.Second):
+		t.Fatal("next request didn't enter")
+	}
+}
+
+func TestQueueTicketTimeout(t *testing.T) {
+	q := newSignQueue()
+	first, err := q.Enter(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Leave()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := q.Enter(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2017, Trusted Key
+This file is part of Trusted Key SSH-Agent.
+
+Trusted Key SSH-Agent is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Trusted Key SSH-Agent is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Trusted Key SSH-Agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+var spinnerFrames = []rune(`|/-\`)
+
+// startSpinner - Animate message on out while waiting until deadline,
+// returns a function removing it again. Only prints the message once if out
+// isn't a terminal.
+func startSpinner(out io.Writer, message string, deadline time.Time) func() {
+	f, ok := out.(*os.File)
+	if !ok || !isTerminal(f) {
+		fmt.Fprintln(out, message)
+		return func() {}
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+
+		for frame := 0; ; frame++ {
+			left := time.Until(deadline).Round(time.Second)
+			if left < 0 {
+				left = 0
+			}
+			fmt.Fprintf(out, "\r%c %s (%s left) ", spinnerFrames[frame%len(spinnerFrames)], message, left)
+
+			select {
+			case <-ticker.C:
+			case <-stop:
+				// Clear the line
+				fmt.Fprint(out, "\r\033[K")
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+	}
+}
@@ -0,0 +1,316 @@
+/*
+Copyright 2017, Trusted Key
+This file is part of Trusted Key SSH-Agent.
+
+Trusted Key SSH-Agent is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Trusted Key SSH-Agent is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Trusted Key SSH-Agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Key export formats, as in ssh-keygen -e -m
+const (
+	exportRFC4716 = "rfc4716"
+	exportPKCS8   = "pkcs8"
+)
+
+// ExportFile - Path of an exported public key next to the tk_<addr>.pub file
+func ExportFile(dir string, addr string, format string) string {
+	switch format {
+	case exportRFC4716:
+		return filepath.Join(dir, fmt.Sprintf("tk_%s.rfc4716.pub", addr))
+	default:
+		return filepath.Join(dir, fmt.Sprintf("tk_%s.pem", addr))
+	}
+}
+
+// ExportPublicKey - key in the SSH2 (RFC 4716) or PKCS8 (PEM encoded
+// SubjectPublicKeyInfo) format
+func ExportPublicKey(key ssh.PublicKey, comment string, format string) ([]byte, error) {
+	switch format {
+	case exportRFC4716:
+		var out bytes.Buffer
+		out.WriteString("---- BEGIN SSH2 PUBLIC KEY ----\n")
+		fmt.Fprintf(&out, "Comment: \"%s\"\n", comment)
+		encoded := base64.StdEncoding.EncodeToString(key.Marshal())
+		// Lines must not be longer than 72 bytes
+		for len(encoded) > 70 {
+			out.WriteString(encoded[:70] + "\n")
+			encoded = encoded[70:]
+		}
+		out.WriteString(encoded + "\n")
+		out.WriteString("---- END SSH2 PUBLIC KEY ----\n")
+		return out.Bytes(), nil
+
+	case exportPKCS8:
+		cryptoKey, ok := key.(ssh.CryptoPublicKey)
+		if !ok {
+			return nil, fmt.Errorf("Can't export %s keys as PKCS8", key.Type())
+		}
+		der, err := x509.MarshalPKIXPublicKey(cryptoKey.CryptoPublicKey())
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+
+	default:
+		return nil, fmt.Errorf("Unknown export format %q, expected %s or %s", format, exportRFC4716, exportPKCS8)
+	}
+}
+
+// DefaultSSHConfig - The user's ssh client configuration, ~/.ssh/config
+func DefaultSSHConfig() (string, error) {
+	dir, err := DefaultPubKeyDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "config"), nil
+}
+
+// managedBlockMarkers - Comments delimiting the block we maintain, one per profile
+func managedBlockMarkers(profile string) (string, string) {
+	name := "tk-ssh-agent"
+	if profile != "" {
+		name = fmt.Sprintf("tk-ssh-agent profile %s", profile)
+	}
+	return fmt.Sprintf("# BEGIN %s managed block, changes will be overwritten", name),
+		fmt.Sprintf("# END %s managed block", name)
+}
+
+// sshConfigQuote - Quote an ssh_config argument containing spaces
+func sshConfigQuote(value string) string {
+	if strings.ContainsAny(value, " \t") {
+		return `"` + value + `"`
+	}
+	return value
+}
+
+// renderManagedBlock - Host block selecting identityFiles through the agent
+// on sockPath for hosts
+func renderManagedBlock(profile string, hosts []string, sockPath string, identityFiles []string) string {
+	begin, end := managedBlockMarkers(profile)
+
+	var block bytes.Buffer
+	block.WriteString(begin + "\n")
+	fmt.Fprintf(&block, "Host %s\n", strings.Join(hosts, " "))
+	fmt.Fprintf(&block, "    IdentityAgent %s\n", sshConfigQuote(sockPath))
+	for _, identityFile := range identityFiles {
+		fmt.Fprintf(&block, "    IdentityFile %s\n", sshConfigQuote(identityFile))
+	}
+	block.WriteString("    IdentitiesOnly yes\n")
+	block.WriteString(end + "\n")
+	return block.String()
+}
+
+// firstHostLine - Offset of the first Host or Match line in an ssh config,
+// including the comments right above it (e.g. another managed block's
+// start), or its length if there is none
+func firstHostLine(text string) int {
+	offset, comments := 0, -1
+	for _, line := range strings.SplitAfter(text, "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+			comments = -1
+		case strings.HasPrefix(fields[0], "#"):
+			if comments < 0 {
+				comments = offset
+			}
+		default:
+			keyword := strings.ToLower(strings.SplitN(fields[0], "=", 2)[0])
+			if keyword == "host" || keyword == "match" {
+				if comments >= 0 {
+					return comments
+				}
+				return offset
+			}
+			comments = -1
+		}
+		offset += len(line)
+	}
+	return len(text)
+}
+
+// UpdateSSHConfig - Replace the managed block of profile in the ssh config
+// at configPath. New blocks go after the global options, which would
+// otherwise only apply to our hosts, and before the first Host or Match
+// line so they take precedence over "Host *".
+func UpdateSSHConfig(configPath string, profile string, block string) error {
+	contents, err := ioutil.ReadFile(configPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	begin, end := managedBlockMarkers(profile)
+	text := string(contents)
+	var updated string
+
+	start := strings.Index(text, begin+"\n")
+	if start < 0 {
+		offset := firstHostLine(text)
+		before, after := text[:offset], text[offset:]
+		if before != "" && !strings.HasSuffix(before, "\n") {
+			before += "\n"
+		}
+		if before != "" && !strings.HasSuffix(before, "\n\n") {
+			before += "\n"
+		}
+		updated = before + block
+		if after != "" {
+			updated += "\n" + after
+		}
+	} else {
+		stop := strings.Index(text[start:], end+"\n")
+		if stop < 0 {
+			return errors.New("Found the start but not the end of the managed block, fix it by hand")
+		}
+		stop += start + len(end) + 1
+		updated = text[:start] + block + text[stop:]
+	}
+
+	return writeSSHConfig(configPath, updated)
+}
+
+// sshConfigUnquote - Reverse sshConfigQuote
+func sshConfigUnquote(value string) string {
+	if len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+// managedBlockPattern - Start of the managed block of any profile
+var managedBlockPattern = regexp.MustCompile(`^# BEGIN tk-ssh-agent (?:profile (\S+) )?managed block`)
+
+// DropSSHConfigIdentity - Remove identityFile from the managed blocks in the
+// ssh config at configPath, blocks left without identities are removed.
+// Returns whether the file was changed.
+func DropSSHConfigIdentity(configPath string, identityFile string) (bool, error) {
+	contents, err := ioutil.ReadFile(configPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	lines := strings.SplitAfter(string(contents), "\n")
+	var updated bytes.Buffer
+	changed := false
+
+	for i := 0; i < len(lines); i++ {
+		match := managedBlockPattern.FindStringSubmatch(lines[i])
+		if match == nil {
+			updated.WriteString(lines[i])
+			continue
+		}
+		profile := match[1]
+		_, end := managedBlockMarkers(profile)
+
+		var hosts, identityFiles []string
+		var sockPath string
+		found := false
+		start := i
+		for i++; i < len(lines) && strings.TrimRight(lines[i], "\n") != end; i++ {
+			fields := strings.SplitN(strings.TrimSpace(lines[i]), " ", 2)
+			if len(fields) < 2 {
+				continue
+			}
+			value := strings.TrimSpace(fields[1])
+			switch fields[0] {
+			case "Host":
+				hosts = strings.Fields(value)
+			case "IdentityAgent":
+				sockPath = sshConfigUnquote(value)
+			case "IdentityFile":
+				if sshConfigUnquote(value) == identityFile {
+					found = true
+				} else {
+					identityFiles = append(identityFiles, sshConfigUnquote(value))
+				}
+			}
+		}
+		if i == len(lines) {
+			return false, errors.New("Found the start but not the end of the managed block, fix it by hand")
+		}
+
+		switch {
+		case !found:
+			updated.WriteString(strings.Join(lines[start:i+1], ""))
+		case len(identityFiles) > 0:
+			updated.WriteString(renderManagedBlock(profile, hosts, sockPath, identityFiles))
+			changed = true
+		default:
+			// Drop the blank line separating the block from the next one
+			if i+1 < len(lines) && lines[i+1] == "\n" {
+				i++
+			}
+			changed = true
+		}
+	}
+
+	if !changed {
+		return false, nil
+	}
+	return true, writeSSHConfig(configPath, updated.String())
+}
+
+// writeSSHConfig - Atomically replace the ssh config at configPath,
+// keeping its permissions. A symlinked config (e.g. from a dotfile manager)
+// stays a symlink, its target is replaced instead.
+func writeSSHConfig(configPath string, text string) error {
+	if target, err := filepath.EvalSymlinks(configPath); err == nil {
+		configPath = target
+	}
+
+	mode := os.FileMode(0600)
+	if info, err := os.Stat(configPath); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	if err := os.MkdirAll(filepath.Dir(configPath), 0700); err != nil {
+		return err
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(configPath), ".config")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.WriteString(text); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpFile.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), configPath)
+}
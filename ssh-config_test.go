@@ -0,0 +1,123 @@
+/*
+Copyright 2017, Trusted Key
+This file is part of Trusted Key SSH-Agent.
+
+Trusted Key SSH-Agent is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Trusted Key SSH-Agent is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Trusted Key SSH-Agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDropSSHConfigIdentity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tk-ssh-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configPath := filepath.Join(dir, "config")
+
+	global := "User me\n\n"
+	other := "Host *\n    ForwardAgent no\n"
+	if err := ioutil.WriteFile(configPath, []byte(global+other), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sockPath := "/run/user/1000/tk ssh.sock"
+	block := renderManagedBlock("", []string{"*.example.com", "bastion"}, sockPath, []string{"/home/me/.ssh/tk_a.pub", "/home/me/.ssh/tk_b.pub"})
+	if err := UpdateSSHConfig(configPath, "", block); err != nil {
+		t.Fatal(err)
+	}
+	staging := renderManagedBlock("staging", []string{"staging"}, sockPath, []string{"/home/me/.ssh/tk_b.pub"})
+	if err := UpdateSSHConfig(configPath, "staging", staging); err != nil {
+		t.Fatal(err)
+	}
+
+	changed, err := DropSSHConfigIdentity(configPath, "/home/me/.ssh/tk_b.pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Fatal("expected the config to change")
+	}
+	contents, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := global + renderManagedBlock("", []string{"*.example.com", "bastion"}, sockPath, []string{"/home/me/.ssh/tk_a.pub"}) + "\n" + other
+	if string(contents) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, contents)
+	}
+
+	changed, err = DropSSHConfigIdentity(configPath, "/home/me/.ssh/tk_c.pub")
+	if err != nil || changed {
+		t.Errorf("expected an unknown identity to leave the config alone, got %v, %v", changed, err)
+	}
+
+	if _, err := DropSSHConfigIdentity(configPath, "/home/me/.ssh/tk_a.pub"); err != nil {
+		t.Fatal(err)
+	}
+	contents, err = ioutil.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != global+other {
+		t.Errorf("expected the empty block to be removed, got:\n%s", contents)
+	}
+}
+
+func TestUpdateSSHConfigSymlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tk-ssh-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// As set up by a dotfile manager
+	target := filepath.Join(dir, "dotfiles", "ssh_config")
+	if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(target, []byte("Host *\n    ForwardAgent no\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	configPath := filepath.Join(dir, "config")
+	if err := os.Symlink(filepath.Join("dotfiles", "ssh_config"), configPath); err != nil {
+		t.Fatal(err)
+	}
+
+	block := renderManagedBlock("", []string{"bastion"}, "/run/tk.sock", []string{"/home/me/.ssh/tk_a.pub"})
+	if err := UpdateSSHConfig(configPath, "", block); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Lstat(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		t.Error("the symlink was replaced with a regular file")
+	}
+	contents, err := ioutil.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := block + "\nHost *\n    ForwardAgent no\n"; string(contents) != expected {
+		t.Errorf("expected the target to be updated to:\n%s\ngot:\n%s", expected, contents)
+	}
+}
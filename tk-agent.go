@@ -32,11 +32,16 @@ import (
 type privKey struct {
 	signer  ssh.Signer
 	comment string
+
+	// Removed with ssh-add -d/-D until re-enabled
+	disabled bool
 }
 
 type keyring struct {
-	mutex sync.Mutex
-	keys  []privKey
+	mutex    sync.Mutex
+	keys     []privKey
+	policy   *Policy
+	notifier Notifier
 
 	locked     bool
 	passphrase []byte
@@ -48,23 +53,56 @@ var errLocked = errors.New("agent: locked")
 
 // NewTKeyring returns an Agent that holds keys in the Trusted Key app.
 // It is safe for concurrent use by multiple goroutines.
-func NewTKeyring(identities []TKIdentity) agent.Agent {
+func NewTKeyring(config *AgentConfig) *keyring {
 	r := &keyring{}
+	err := r.Reload(config)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+func sameIdentity(a TKIdentity, b TKIdentity) bool {
+	return bytes.Equal(a.pubkey, b.pubkey) &&
+		a.rpURL == b.rpURL &&
+		a.clientID == b.clientID &&
+		a.clientSecret == b.clientSecret
+}
+
+// Reload - Atomically replace identities and settings. Unchanged identities
+// keep their signer, in-flight requests finish with the signer they started on.
+func (r *keyring) Reload(config *AgentConfig) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
 
-	for _, identity := range identities {
-		signer, err := NewTKSigner(identity)
-		if err != nil {
-			panic(err)
+	var keys []privKey
+	for _, identity := range config.Identities {
+		var p *privKey
+		for i, k := range r.keys {
+			tkSigner, ok := k.signer.(*trustedKeySigner)
+			if ok && sameIdentity(tkSigner.identity, identity) && tkSigner.options == config.Options {
+				p = &r.keys[i]
+				break
+			}
 		}
 
-		p := privKey{
-			signer:  signer,
-			comment: identity.addr,
+		if p == nil {
+			signer, err := NewTKSigner(identity, config.Options)
+			if err != nil {
+				return err
+			}
+			p = &privKey{
+				signer:  signer,
+				comment: identity.addr,
+			}
 		}
-		r.keys = append(r.keys, p)
+		keys = append(keys, *p)
 	}
 
-	return r
+	r.keys = keys
+	r.policy = config.Policy
+	r.notifier = config.Notifier
+	return nil
 }
 
 func (r *keyring) List() ([]*agent.Key, error) {
@@ -77,6 +115,9 @@ func (r *keyring) List() ([]*agent.Key, error) {
 
 	var ids []*agent.Key
 	for _, k := range r.keys {
+		if k.disabled {
+			continue
+		}
 		pub := k.signer.PublicKey()
 		ids = append(ids, &agent.Key{
 			Format:  pub.Type(),
@@ -87,6 +128,16 @@ func (r *keyring) List() ([]*agent.Key, error) {
 }
 
 func (r *keyring) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return r.SignConn(key, data, nil)
+}
+
+func (r *keyring) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	// Flags only apply to RSA keys, Trusted Key identities are always ECDSA
+	return r.Sign(key, data)
+}
+
+// SignConn - Sign on behalf of a client connection, conn may be nil
+func (r *keyring) SignConn(key ssh.PublicKey, data []byte, conn *ConnInfo) (*ssh.Signature, error) {
 	if r.locked {
 		return nil, errLocked
 	}
@@ -95,11 +146,13 @@ func (r *keyring) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
 	wanted := key.Marshal()
 	var signer ssh.Signer
 	for _, k := range r.keys {
-		if bytes.Equal(k.signer.PublicKey().Marshal(), wanted) {
+		if !k.disabled && bytes.Equal(k.signer.PublicKey().Marshal(), wanted) {
 			signer = k.signer
 			break
 		}
 	}
+	policy := r.policy
+	notifier := r.notifier
 
 	// Unlock before we actually call sign to prevent deadlocks
 	r.mutex.Unlock()
@@ -107,19 +160,120 @@ func (r *keyring) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
 		return nil, ErrSignerNotFound
 	}
 
+	if tkSigner, ok := signer.(*trustedKeySigner); ok {
+		// Deny before bothering the user's phone
+		if err := policy.Check(tkSigner.identity, conn); err != nil {
+			return nil, err
+		}
+		// Like OpenSSH does for destination constrained keys, other
+		// identities may sign anything (e.g. git commits with SSHSIG)
+		if policy.DestinationConstrained(tkSigner.identity) {
+			if err := checkSessionBind(conn.Bind(), data); err != nil {
+				return nil, err
+			}
+		}
+		return tkSigner.SignConn(data, conn, notifier)
+	}
 	return signer.Sign(rand.Reader, data)
 }
 
+// CancelPending - Abort running and queued requests for all identities
+func (r *keyring) CancelPending() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, k := range r.keys {
+		if tkSigner, ok := k.signer.(*trustedKeySigner); ok {
+			tkSigner.CancelPending()
+		}
+	}
+}
+
+// Extension - Session state is per connection and handled by connAgent
+func (r *keyring) Extension(extensionType string, contents []byte) ([]byte, error) {
+	return nil, agent.ErrExtensionUnsupported
+}
+
 func (r *keyring) Add(key agent.AddedKey) error {
-	return errors.New("Removing not supported, edit config file and reload")
+	return errors.New("Adding not supported, enroll a new identity instead")
 }
 
+// Remove - Disable an identity for the lifetime of the agent
 func (r *keyring) Remove(key ssh.PublicKey) error {
-	return errors.New("Removing not supported, edit config file and reload")
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.locked {
+		return errLocked
+	}
+
+	wanted := key.Marshal()
+	for i, k := range r.keys {
+		if !k.disabled && bytes.Equal(k.signer.PublicKey().Marshal(), wanted) {
+			r.keys[i].disabled = true
+			return nil
+		}
+	}
+	return ErrSignerNotFound
 }
 
+// RemoveAll - Disable all identities for the lifetime of the agent
 func (r *keyring) RemoveAll() error {
-	return errors.New("Removing not supported, edit config file and reload")
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.locked {
+		return errLocked
+	}
+
+	for i := range r.keys {
+		r.keys[i].disabled = true
+	}
+	return nil
+}
+
+// EnableAll - Re-enable identities removed with Remove or RemoveAll
+func (r *keyring) EnableAll() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for i := range r.keys {
+		r.keys[i].disabled = false
+	}
+}
+
+// Drop - Forget an identity until it's enrolled again, aborting its pending requests
+func (r *keyring) Drop(key ssh.PublicKey) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	wanted := key.Marshal()
+	for i, k := range r.keys {
+		if !bytes.Equal(k.signer.PublicKey().Marshal(), wanted) {
+			continue
+		}
+		if tkSigner, ok := k.signer.(*trustedKeySigner); ok {
+			tkSigner.CancelPending()
+		}
+		r.keys = append(r.keys[:i:i], r.keys[i+1:]...)
+		return nil
+	}
+	return ErrSignerNotFound
+}
+
+// Status - All identities, including disabled ones
+func (r *keyring) Status() ([]IdentityStatus, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.locked {
+		return nil, errLocked
+	}
+
+	var statuses []IdentityStatus
+	for _, k := range r.keys {
+		statuses = append(statuses, IdentityStatus{
+			Blob:     k.signer.PublicKey().Marshal(),
+			Comment:  k.comment,
+			Disabled: k.disabled,
+		})
+	}
+	return statuses, nil
 }
 
 func (r *keyring) Lock(passphrase []byte) error {
@@ -158,6 +312,9 @@ func (r *keyring) Signers() ([]ssh.Signer, error) {
 
 	s := make([]ssh.Signer, 0, len(r.keys))
 	for _, k := range r.keys {
+		if k.disabled {
+			continue
+		}
 		s = append(s, k.signer)
 	}
 	return s, nil
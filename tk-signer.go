@@ -19,18 +19,53 @@ along with Trusted Key SSH-Agent.  If not, see <http://www.gnu.org/licenses/>.
 package main
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/asn1"
 	"encoding/base64"
 	"errors"
+	"fmt"
 	"golang.org/x/crypto/ssh"
 	"io"
 	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+// SignOptions - Settings for the signing flow shared by all identities
+type SignOptions struct {
+	SignTimeout    time.Duration // The whole flow, including waiting for the user
+	RequestTimeout time.Duration // Each HTTP request to the relying party
+	ApprovalWindow time.Duration // Let the RP approve repeated logins to a host, zero disables
+}
+
+// signCancelTimeout - How long telling the RP about an aborted login may take
+const signCancelTimeout = 5 * time.Second
+
+// DefaultSignOptions - Timeouts match the lifetime of the JWS sent to the RP
+var DefaultSignOptions = SignOptions{
+	SignTimeout:    180 * time.Second,
+	RequestTimeout: 60 * time.Second,
+}
+
+// approvalGrant - A recent approval for logging in to a host
+type approvalGrant struct {
+	loginRequestID string // The approved request, sent along with repeated logins
+	approved       time.Time
+	expires        time.Time
+}
+
 type trustedKeySigner struct {
 	pub      ssh.PublicKey
 	identity TKIdentity
+	options  SignOptions
+
+	queue *signQueue
+
+	mutex  sync.Mutex
+	grants map[string]approvalGrant // Keyed by host key fingerprint
 }
 
 type asn1signature struct {
@@ -46,27 +81,161 @@ func encodeData(data []byte) []byte {
 }
 
 // NewTKSigner returns a Signer that signs with the given something
-func NewTKSigner(identity TKIdentity) (ssh.Signer, error) {
+func NewTKSigner(identity TKIdentity, options SignOptions) (ssh.Signer, error) {
 	pub, err := UserPubKeyHexToSSHPubKey(identity.pubkey)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+
+	return &trustedKeySigner{
+		pub:      pub,
+		identity: identity,
+		options:  options,
+		queue:    newSignQueue(),
+		grants:   make(map[string]approvalGrant),
+	}, nil
+}
+
+// grant - Look up an unexpired approval for the bound host
+func (s *trustedKeySigner) grant(bind *sessionBind) (approvalGrant, bool) {
+	if bind == nil || s.options.ApprovalWindow <= 0 {
+		return approvalGrant{}, false
 	}
 
-	return &trustedKeySigner{pub, identity}, nil
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	grant, ok := s.grants[bind.Fingerprint()]
+	if ok && time.Now().After(grant.expires) {
+		delete(s.grants, bind.Fingerprint())
+		return approvalGrant{}, false
+	}
+	return grant, ok
+}
+
+// addGrant - Remember an approved login to the bound host
+func (s *trustedKeySigner) addGrant(bind *sessionBind, loginRequestID string) {
+	if bind == nil || s.options.ApprovalWindow <= 0 {
+		return
+	}
+
+	now := time.Now()
+	grant := approvalGrant{
+		loginRequestID: loginRequestID,
+		approved:       now,
+		expires:        now.Add(s.options.ApprovalWindow),
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// Extending an existing grant would allow approving once forever
+	if _, ok := s.grants[bind.Fingerprint()]; !ok {
+		s.grants[bind.Fingerprint()] = grant
+	}
 }
 
 func (s *trustedKeySigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.SignConn(data, nil, nil)
+}
+
+// get - Send a single request to the RP bounded by the request timeout
+func (s *trustedKeySigner) get(ctx context.Context, requestPath string, params map[string]string) (map[string]interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.options.RequestTimeout)
+	defer cancel()
+	return HTTPGet(ctx, s.identity, requestPath, params)
+}
+
+// waitSignature - Poll /sshloginPart2 until the user answered on the phone,
+// retrying transient failures with backoff until ctx is done
+func (s *trustedKeySigner) waitSignature(ctx context.Context, loginRequestID string) (map[string]interface{}, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := s.get(ctx, "/sshloginPart2", map[string]string{
+			"loginRequestId": loginRequestID,
+		})
+		if err == nil {
+			return resp, nil
+		}
+		if ctx.Err() != nil || !isRetryable(err) {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(backoff(attempt)):
+		}
+	}
+}
+
+// cancelLogin - Tell the RP we are no longer waiting for the user so the
+// request is withdrawn from the phone, best effort
+func (s *trustedKeySigner) cancelLogin(conn *ConnInfo, loginRequestID string) {
+	// The signing context is already done, use a fresh one
+	ctx, cancel := context.WithTimeout(context.Background(), signCancelTimeout)
+	defer cancel()
+	_, err := HTTPGet(ctx, s.identity, "/sshloginCancel", map[string]string{
+		"loginRequestId": loginRequestID,
+	})
+	if err != nil {
+		Audit(conn, "could not withdraw login request %s: %s", loginRequestID, err)
+	}
+}
+
+// CancelPending - Abort the running and all queued requests
+func (s *trustedKeySigner) CancelPending() {
+	s.queue.CancelAll()
+}
+
+// SignConn - Sign data on behalf of a client connection, conn may be nil.
+// Requests are handled one at a time and abort when the client disconnects,
+// the user cancels or the total timeout expires. The user is told about the
+// request through notifier, nil for the platform default.
+func (s *trustedKeySigner) SignConn(data []byte, conn *ConnInfo, notifier Notifier) (*ssh.Signature, error) {
+	ticket, err := s.queue.Enter(conn.Context())
+	if err == ErrSignCancelled {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("agent: signature request aborted: %s", err)
+	}
+	defer ticket.Leave()
+
+	// Time spent waiting in the queue doesn't count
+	ctx, cancel := context.WithTimeout(ticket.Context(), s.options.SignTimeout)
+	defer cancel()
+
 	b := sha256.Sum256(data)
 	encodedData := encodeData(b[:])
 
-	// Send signature request
-	resp, err := HTTPGet(s.identity, "/sshlogin", map[string]string{
+	params := map[string]string{
 		"nonce":          string(encodedData),
 		"subjectaddress": s.identity.addr,
-	})
+	}
+	bind := conn.Bind()
+	if bind != nil {
+		params["hostkeyfingerprint"] = bind.Fingerprint()
+		if len(bind.hostnames) > 0 {
+			params["hostname"] = strings.Join(bind.hostnames, ",")
+		}
+	}
+	// The RP decides whether the phone approves repeated logins by itself
+	if bind != nil && s.options.ApprovalWindow > 0 {
+		params["approvalWindow"] = strconv.Itoa(int(s.options.ApprovalWindow.Seconds()))
+	}
+	grant, granted := s.grant(bind)
+	if granted {
+		params["approvedLoginRequestId"] = grant.loginRequestID
+	}
+
+	// Send signature request
+	resp, err := s.get(ctx, "/sshlogin", params)
 	if err != nil {
 		return nil, err
 	}
+	preapproved, _ := resp["preapproved"].(bool)
+	if granted && preapproved {
+		Audit(conn, "login to %s pre-approved by the relying party until %s", bind, grant.expires.Format(time.Kitchen))
+	} else if granted {
+		Audit(conn, "relying party asks to approve login to %s again", bind)
+	}
 
 	callbackURL := resp["callbackUrl"]
 	if callbackURL == nil {
@@ -78,21 +247,53 @@ func (s *trustedKeySigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, er
 	}
 
 	otp := OneTimePassword(encodedData, []byte(callbackURL.(string)))
-	Notify(otp)
+	details := conn.Details()
+	if granted && preapproved {
+		details = append(details, fmt.Sprintf("Pre-approved: login to this host approved at %s, no need to confirm", grant.approved.Format(time.Kitchen)))
+	}
+	if pending := s.queue.Pending() - 1; pending > 0 {
+		details = append(details, fmt.Sprintf("Pending: %d more requests", pending))
+	}
+	request := NewNotifyRequest(otp, details...)
+	if conn != nil && conn.Peer != nil {
+		request.PID = conn.Peer.Pid
+	}
+	request.Cancel = func() {
+		Audit(conn, "request cancelled from the notification")
+		ticket.Cancel()
+	}
+	notification := Notify(notifier, request)
 
-	resp, err = HTTPGet(s.identity, "/sshloginPart2", map[string]string{
-		"loginRequestId": loginRequestID.(string),
-	})
+	resp, err = s.waitSignature(ctx, loginRequestID.(string))
+	notification.Done(err == nil)
 	if err != nil {
+		if ctx.Err() != nil {
+			s.cancelLogin(conn, loginRequestID.(string))
+			if ticket.Err() == ErrSignCancelled {
+				return nil, ErrSignCancelled
+			}
+			return nil, fmt.Errorf("agent: signature request aborted: %s", ctx.Err())
+		}
 		return nil, err
 	}
 
-	signatureResp := resp["signature"]
-	if signatureResp == nil {
+	sig, err := s.decodeSignature(resp)
+	if err != nil {
+		return nil, err
+	}
+	s.addGrant(bind, loginRequestID.(string))
+
+	return sig, nil
+}
+
+// decodeSignature - Convert the ASN.1 signature from the RP to SSH format
+func (s *trustedKeySigner) decodeSignature(resp map[string]interface{}) (*ssh.Signature, error) {
+	signatureResp, ok := resp["signature"].(string)
+	if !ok {
 		return nil, errors.New("Missing signature from server response")
 	}
 
-	sig, err := base64.StdEncoding.DecodeString(signatureResp.(string))
+	sig, err := base64.StdEncoding.DecodeString(signatureResp)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,173 @@
+/*
+Copyright 2017, Trusted Key
+This file is part of Trusted Key SSH-Agent.
+
+Trusted Key SSH-Agent is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Trusted Key SSH-Agent is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Trusted Key SSH-Agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignConnWithdrawsCancelledLogin(t *testing.T) {
+	cancelled := make(chan string, 1)
+	waiting := make(chan struct{}, 1)
+	rp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/sshlogin":
+			w.Write([]byte(`{"callbackUrl":"https://rp.example.com/cb","loginRequestId":"req1"}`))
+		case "/sshloginPart2":
+			// The user never answers
+			waiting <- struct{}{}
+			<-r.Context().Done()
+		case "/sshloginCancel":
+			cancelled <- r.URL.Query().Get("loginRequestId")
+			w.Write([]byte(`{}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer rp.Close()
+
+	identity := TKIdentity{
+		rpURL:        rp.URL,
+		pubkey:       []byte(testPubKey),
+		clientID:     "client",
+		clientSecret: "secret",
+	}
+	signer, err := NewTKSigner(identity, SignOptions{SignTimeout: time.Minute, RequestTimeout: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tkSigner := signer.(*trustedKeySigner)
+
+	go func() {
+		<-waiting
+		tkSigner.CancelPending()
+	}()
+	notifier := notifyFunc(func(request *NotifyRequest) error { return nil })
+	if _, err := tkSigner.SignConn([]byte("data"), nil, notifier); err != ErrSignCancelled {
+		t.Fatalf("expected ErrSignCancelled, got %v", err)
+	}
+
+	select {
+	case id := <-cancelled:
+		if id != "req1" {
+			t.Errorf("expected req1 to be withdrawn, got %q", id)
+		}
+	default:
+		t.Error("login request not withdrawn from the RP")
+	}
+}
+
+func TestSignConnSendsApprovalWindow(t *testing.T) {
+	signature, err := asn1.Marshal(asn1signature{R: big.NewInt(1), S: big.NewInt(2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logins []url.Values
+	confirm := false
+	rp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/sshlogin":
+			query := r.URL.Query()
+			logins = append(logins, query)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"callbackUrl":    "https://rp.example.com/cb",
+				"loginRequestId": fmt.Sprintf("req%d", len(logins)),
+				"preapproved":    confirm && query.Get("approvedLoginRequestId") != "",
+			})
+		case "/sshloginPart2":
+			json.NewEncoder(w).Encode(map[string]string{
+				"signature": base64.StdEncoding.EncodeToString(signature),
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer rp.Close()
+
+	identity := TKIdentity{
+		rpURL:        rp.URL,
+		pubkey:       []byte(testPubKey),
+		clientID:     "client",
+		clientSecret: "secret",
+	}
+	signer, err := NewTKSigner(identity, SignOptions{SignTimeout: time.Minute, RequestTimeout: time.Minute, ApprovalWindow: 5 * time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tkSigner := signer.(*trustedKeySigner)
+
+	bind, err := parseSessionBind(testSessionBind(t, []byte("session"), false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &ConnInfo{ctx: context.Background()}
+	if err := conn.addBind(bind); err != nil {
+		t.Fatal(err)
+	}
+
+	var details []string
+	notifier := notifyFunc(func(request *NotifyRequest) error {
+		details = request.Details
+		return nil
+	})
+	preapproved := func() bool {
+		for _, detail := range details {
+			if strings.HasPrefix(detail, "Pre-approved") {
+				return true
+			}
+		}
+		return false
+	}
+
+	for i, test := range []struct {
+		confirm     bool
+		approved    string // approvedLoginRequestId sent to the RP
+		preapproved bool   // Shown in the notification
+	}{
+		{false, "", false},
+		{false, "req1", false}, // The RP ignores the grant
+		{true, "req1", true},
+	} {
+		confirm = test.confirm
+		if _, err := tkSigner.SignConn([]byte("data"), conn, notifier); err != nil {
+			t.Fatal(err)
+		}
+		login := logins[len(logins)-1]
+		if login.Get("approvalWindow") != "300" {
+			t.Errorf("%d: expected approvalWindow 300, got %q", i, login.Get("approvalWindow"))
+		}
+		if login.Get("approvedLoginRequestId") != test.approved {
+			t.Errorf("%d: expected approvedLoginRequestId %q, got %q", i, test.approved, login.Get("approvedLoginRequestId"))
+		}
+		if preapproved() != test.preapproved {
+			t.Errorf("%d: expected pre-approved %v in the notification, got %v", i, test.preapproved, details)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+/*
+Copyright 2017, Trusted Key
+This file is part of Trusted Key SSH-Agent.
+
+Trusted Key SSH-Agent is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Trusted Key SSH-Agent is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Trusted Key SSH-Agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// findIdentity - Public key of the enrolled identity ref refers to, by
+// public key, subject address or SHA256 fingerprint
+func findIdentity(config *ConfigFile, ref string) (string, error) {
+	for pubkey := range config.Identities {
+		if matchIdentity(ref, pubkey) {
+			return pubkey, nil
+		}
+		key, err := UserPubKeyHexToSSHPubKey([]byte(pubkey))
+		if err == nil && ssh.FingerprintSHA256(key) == ref {
+			return pubkey, nil
+		}
+	}
+	return "", fmt.Errorf("No enrolled identity matches '%s'", ref)
+}
+
+// forgetIdentity - Remove an identity and every reference to it from config
+func forgetIdentity(config *ConfigFile, pubkey string) {
+	delete(config.Identities, pubkey)
+
+	forgetPolicy := func(settings *Settings) {
+		for key := range settings.Policy {
+			if strings.EqualFold(key, pubkey) {
+				delete(settings.Policy, key)
+			}
+		}
+	}
+	forgetPolicy(&config.Config)
+
+	for _, profile := range config.Profiles {
+		var identities []string
+		for _, entry := range profile.Identities {
+			if !matchIdentity(entry, pubkey) {
+				identities = append(identities, entry)
+			}
+		}
+		profile.Identities = identities
+		forgetPolicy(&profile.Config)
+	}
+}
+
+// unenrollFiles - Public key files and exports enroll wrote for identity
+func unenrollFiles(identity *IdentityConfig, addr string) []string {
+	if identity.PubKeyFile != "" {
+		return append([]string{identity.PubKeyFile}, identity.ExportFiles...)
+	}
+
+	// Identities enrolled before the files were recorded
+	dir, err := DefaultPubKeyDir()
+	if err != nil {
+		return nil
+	}
+	return []string{
+		PubKeyFile(dir, addr),
+		ExportFile(dir, addr, exportRFC4716),
+		ExportFile(dir, addr, exportPKCS8),
+	}
+}
+
+// revokeIdentity - Ask the relying party to revoke the client credentials
+func revokeIdentity(config *ConfigFile, pubkey string) error {
+	settings, err := config.EffectiveSettings()
+	if err != nil {
+		return err
+	}
+	secrets := NewSecrets()
+	secrets.SetPassphraseCommand(settings.PassphraseCommand)
+
+	single := &ConfigFile{
+		Identities: map[string]*IdentityConfig{pubkey: config.Identities[pubkey]},
+	}
+	identities, err := single.TKIdentities(secrets)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), settings.SignOptions().RequestTimeout)
+	defer cancel()
+	_, err = HTTPGet(ctx, identities[0], "/sshrevoke", nil)
+	if e, ok := err.(*HTTPStatusError); ok && (e.StatusCode == http.StatusNotFound || e.StatusCode == http.StatusMethodNotAllowed) {
+		return fmt.Errorf("%s doesn't support revoking credentials (%s)", identities[0].rpURL, err)
+	}
+	return err
+}
+
+// UnenrollMain - Remove an identity from the configuration, the files and
+// Secret Service item written by enroll and the running agent, revoking it
+// on the relying party first if asked to
+func UnenrollMain(configPath string, ref string, sockPath string, revoke bool) error {
+	config, err := ReadConfigFile(configPath)
+	if err != nil {
+		return err
+	}
+
+	pubkey, err := findIdentity(config, ref)
+	if err != nil {
+		return err
+	}
+	addr, err := UserPubKeyHexToAddress([]byte(pubkey))
+	if err != nil {
+		return err
+	}
+	key, err := UserPubKeyHexToSSHPubKey([]byte(pubkey))
+	if err != nil {
+		return err
+	}
+	identity := config.Identities[pubkey]
+
+	// Keep the identity around to retry with when revoking fails
+	if revoke {
+		if err := revokeIdentity(config, pubkey); err != nil {
+			return fmt.Errorf("Could not revoke %s, the identity was not removed (leave out --revoke to only remove it locally): %s", addr, err)
+		}
+		fmt.Println(fmt.Sprintf("Revoked the client credentials of %s on %s", addr, identity.RpURL))
+	}
+
+	forgetIdentity(config, pubkey)
+	if err := WriteConfigFile(configPath, config); err != nil {
+		return err
+	}
+	fmt.Println(fmt.Sprintf("Removed %s from %s", addr, configPath))
+
+	files := unenrollFiles(identity, addr)
+	sshConfigPath := identity.SSHConfig
+	if sshConfigPath == "" {
+		sshConfigPath, _ = DefaultSSHConfig()
+	}
+	if sshConfigPath != "" && len(files) > 0 {
+		changed, err := DropSSHConfigIdentity(sshConfigPath, files[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, fmt.Sprintf("Could not update %s: %s", sshConfigPath, err))
+		} else if changed {
+			fmt.Println(fmt.Sprintf("Removed %s from %s", files[0], sshConfigPath))
+		}
+	}
+
+	for _, file := range files {
+		err := os.Remove(file)
+		if err == nil {
+			fmt.Println(fmt.Sprintf("Removed %s", file))
+		} else if !os.IsNotExist(err) {
+			fmt.Fprintln(os.Stderr, fmt.Sprintf("Could not remove %s: %s", file, err))
+		}
+	}
+
+	if identity.SecretService {
+		if err := secretServiceDelete(identity.ClientID); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		} else {
+			fmt.Println("Removed the client secret from the Secret Service")
+		}
+	}
+
+	if err := DropIdentity(sockPath, key); err != nil {
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("Could not notify agent at %s, reload it to drop the identity: %s", sockPath, err))
+	} else {
+		fmt.Println("Dropped identity from the running agent")
+	}
+
+	return nil
+}
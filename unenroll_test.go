@@ -0,0 +1,90 @@
+/*
+Copyright 2017, Trusted Key
+This file is part of Trusted Key SSH-Agent.
+
+Trusted Key SSH-Agent is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Trusted Key SSH-Agent is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Trusted Key SSH-Agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnenrollRevoke(t *testing.T) {
+	revokeStatus := http.StatusNotFound
+	revoked := 0
+	rp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/sshrevoke" {
+			http.NotFound(w, r)
+			return
+		}
+		revoked++
+		w.WriteHeader(revokeStatus)
+		w.Write([]byte(`{}`))
+	}))
+	defer rp.Close()
+
+	configPath, cleanup := writeTestConfig(t, "{}")
+	defer cleanup()
+	dir := filepath.Dir(configPath)
+	contents := fmt.Sprintf(`{
+  "version": 5,
+  "identities": {
+    "%s": {
+      "rpURL": "%s",
+      "clientId": "client",
+      "clientSecret": "secret",
+      "pubkeyFile": "%s",
+      "sshConfig": "%s"
+    }
+  }
+}`, testPubKey, rp.URL, filepath.Join(dir, "tk.pub"), filepath.Join(dir, "ssh_config"))
+	if err := ioutil.WriteFile(configPath, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sockPath := filepath.Join(dir, "missing.sock")
+
+	// Unsupported by the RP, the identity stays
+	if err := UnenrollMain(configPath, testPubKey, sockPath, true); err == nil {
+		t.Fatal("expected revoking to fail")
+	}
+	config, err := ReadConfigFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Identities[testPubKey] == nil {
+		t.Fatal("identity removed although revoking failed")
+	}
+
+	revokeStatus = http.StatusOK
+	if err := UnenrollMain(configPath, testPubKey, sockPath, true); err != nil {
+		t.Fatal(err)
+	}
+	if revoked != 2 {
+		t.Errorf("expected 2 revoke requests, got %d", revoked)
+	}
+	config, err = ReadConfigFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Identities[testPubKey] != nil {
+		t.Error("identity not removed after revoking")
+	}
+}
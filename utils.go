@@ -30,6 +30,9 @@ import (
 	"errors"
 	"fmt"
 	"golang.org/x/crypto/ssh"
+	"os/user"
+	"path"
+	"strings"
 )
 
 func readInt32(data []byte) (ret int32) {
@@ -81,3 +84,41 @@ func UserPubKeyHexToSSHPubKey(pub []byte) (ssh.PublicKey, error) {
 
 	return ssh.NewPublicKey(ecPub)
 }
+
+// UserPubKeyHexToAuthorizedKey - authorized_keys line for a public key,
+// commented with its subject address
+func UserPubKeyHexToAuthorizedKey(pub []byte) (string, error) {
+	addr, err := UserPubKeyHexToAddress(pub)
+	if err != nil {
+		return "", err
+	}
+
+	key, err := UserPubKeyHexToSSHPubKey(pub)
+	if err != nil {
+		return "", err
+	}
+
+	line := ssh.MarshalAuthorizedKey(key)
+	return fmt.Sprintf("%s %s", string(line[:len(line)-1]), addr), nil
+}
+
+// DefaultPubKeyDir - Where enroll writes public key files, ~/.ssh
+func DefaultPubKeyDir() (string, error) {
+	usr, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(usr.HomeDir, ".ssh"), nil
+}
+
+// PubKeyFile - Path of the public key file for the identity with subject address addr
+func PubKeyFile(dir string, addr string) string {
+	return path.Join(dir, fmt.Sprintf("tk_%s.pub", addr))
+}
+
+// splitList - Split a comma or space separated flag or setting value
+func splitList(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+}